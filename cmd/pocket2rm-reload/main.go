@@ -13,22 +13,55 @@ func startPocket2rm() {
 	cmd.Run()
 }
 
+// scheduledSyncDue reports whether the configured sync interval has passed
+// since both the last sync and the last time one was requested
+func scheduledSyncDue(config *u.AppConfig, lastRequested time.Time) bool {
+	interval := config.GetSyncInterval()
+	if interval == 0 {
+		return false
+	}
+
+	lastSync := lastRequested
+	if summary := u.GetLastSync(); summary != nil && summary.Started.After(lastSync) {
+		lastSync = summary.Started
+	}
+	return time.Since(lastSync) > interval
+}
+
 func main() {
 	fmt.Println("start program")
 
 	var config *u.AppConfig
 	var svc u.ReaderService
 	var rm u.Remarkable
+	var err error
+	var lastRequested time.Time
+
+	config = u.GetAppConfig()
+	if config.Server.Listen != "" || config.Server.ConfigUI {
+		go func() {
+			err := u.StartServer(config.Server, config.Server.ConfigUI)
+			fmt.Println("server stopped: ", err)
+		}()
+	}
 
 	for {
 		fmt.Println("sleep for 10 secs")
 		time.Sleep(10 * time.Second)
 
 		config = u.GetAppConfig()
-		svc, _ = u.GetService(config)
+		svc, err = u.GetService(config)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
 		rm = u.Remarkable{Config: svc.GetRemarkableConfig()}
 
-		if rm.ReloadFileExists() {
+		if scheduledSyncDue(config, lastRequested) {
+			fmt.Println("scheduled sync, starting pocket2rm")
+			lastRequested = time.Now()
+			u.RequestSync()
+		} else if rm.ReloadFileExists() {
 			fmt.Println("reload file exists")
 		} else {
 			fmt.Println("no reload file, starting pocket2rm")
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	u "pocket2rm/internal/utils"
+)
+
+// runAdd implements `pocket2rm add [-f file] [url...]`
+func runAdd(args []string) {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	listPath := flags.String("f", "", "read urls from this file, one per line (- for stdin)")
+	noSave := flags.Bool("no-save", false, "only deliver to the tablet, do not save the urls to the service")
+	dryRun := flags.Bool("dry-run", false, "show what would be delivered without touching the tablet or the service")
+	flags.Parse(args)
+
+	urls := flags.Args()
+	if *listPath != "" {
+		listFile := os.Stdin
+		if *listPath != "-" {
+			f, err := os.Open(*listPath)
+			if err != nil {
+				fmt.Println("Could not open url list: ", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			listFile = f
+		}
+
+		listed, err := u.ReadURLList(listFile)
+		if err != nil {
+			fmt.Println("Could not read url list: ", err)
+			os.Exit(1)
+		}
+		urls = append(urls, listed...)
+	}
+
+	if len(urls) == 0 {
+		fmt.Println("usage: pocket2rm add [-f file] [-no-save] [-dry-run] [url...]")
+		os.Exit(2)
+	}
+
+	config := u.GetAppConfig()
+	svc, err := u.GetService(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	rm := u.Remarkable{Config: svc.GetRemarkableConfig()}
+	if !*dryRun && !rm.TargetFolderExists() {
+		fmt.Println("no target folder")
+		rm.GenerateTargetFolder()
+		svc, _ = u.GetService(u.GetAppConfig())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	summary := u.AddURLs(ctx, svc, urls, u.AddOptions{Save: !*noSave, DryRun: *dryRun})
+	summary.Print()
+
+	if !*dryRun {
+		fmt.Println("restart xochitl (systemctl restart xochitl) to see the new documents")
+	}
+}
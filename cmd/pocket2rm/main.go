@@ -1,27 +1,68 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	u "pocket2rm/internal/utils"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "add" {
+		runAdd(os.Args[2:])
+		return
+	}
+
+	dryRun := flag.Bool("dry-run", false, "show what a sync would do without touching the tablet or the service")
+	flag.Parse()
+
 	fmt.Println("start program")
-	var maxFiles uint = 10
 
 	config := u.GetAppConfig()
-	svc, _ := u.GetService(config)
+	svc, err := u.GetService(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	rm := u.Remarkable{Config: svc.GetRemarkableConfig()}
 
-	if rm.ReloadFileExists() {
+	// on SIGTERM (systemctl stop) the document being written is finished and
+	// the service updated before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, config.GetSyncTimeout())
+	defer cancel()
+
+	opts := u.SyncOptions{MaxArticles: config.GetMaxArticles(), Concurrency: config.GetConcurrency(), DryRun: *dryRun, Digest: config.Digest}
+
+	if opts.DryRun {
+		summary, _ := svc.GenerateFiles(ctx, opts)
+		summary.Print()
+		return
+	}
+
+	rm.RecoverInterruptedWrites()
+
+	syncRequested := u.SyncRequested()
+	if rm.ReloadFileExists() && !syncRequested {
 		fmt.Println("reload file exists")
-	} else {
+		return
+	}
+
+	if !rm.TargetFolderExists() {
+		fmt.Println("no target folder")
+		rm.GenerateTargetFolder()
+		svc, _ = u.GetService(u.GetAppConfig())
+	}
+	if !rm.ReloadFileExists() {
 		fmt.Println("no reload file")
-		if !rm.TargetFolderExists() {
-			fmt.Println("no target folder")
-			rm.GenerateTargetFolder()
-		}
 		rm.GenerateReloadFile()
-		_ = svc.GenerateFiles(maxFiles)
 	}
+	summary, _ := svc.GenerateFiles(ctx, opts)
+	summary.Print()
+	u.WriteLastSync(summary)
 }
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+type AddOptions struct {
+	// Save also saves each URL to the configured service and marks it handled
+	Save   bool
+	DryRun bool
+}
+
+// AddURLs delivers the given URLs straight into the target folder of the
+// service, without waiting for them to show up in the service's queue
+func AddURLs(ctx context.Context, svc ReaderService, urls []string, opts AddOptions) *SyncSummary {
+	defer lockShared()()
+	// the config is read once for the whole sync
+	appConfig := GetAppConfig()
+
+	summary := newSyncSummary(svc.GetRemarkableConfig().Service, SyncOptions{DryRun: opts.DryRun})
+	rm := newDocumentWriter(appConfig.GetStorageLimits(), svc.GetRemarkableConfig(), SyncOptions{DryRun: opts.DryRun})
+
+	for _, rawURL := range urls {
+		if ctx.Err() != nil {
+			summary.finish(ctx)
+			break
+		}
+
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Println("Not a valid url: ", rawURL)
+			summary.addSkipped("", rawURL, "not a valid url")
+			continue
+		}
+
+		doc, err := convertURL(ctx, appConfig, u, articleMetadata{})
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Could not convert article: %s (%s)", err, u))
+			summary.addSkipped("", u.String(), err.Error())
+			continue
+		}
+
+		fileName := documentName(appConfig, doc.title, doc)
+		_, err = rm.writeDocument(fileName, doc)
+		if err != nil {
+			summary.addSkipped(doc.title, u.String(), fmt.Sprintf("could not write document: %s", err))
+			continue
+		}
+		summary.addDocument(doc.title, u.String(), fileName, doc.fileType)
+
+		if !opts.Save {
+			continue
+		}
+		if opts.DryRun {
+			fmt.Println("dry-run: would save to", svc.GetRemarkableConfig().Service, u)
+			continue
+		}
+		err = svc.SaveURL(ctx, u, doc.title)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Could not save url to %s: %s", svc.GetRemarkableConfig().Service, err))
+		}
+	}
+
+	return summary
+}
+
+// AddHTML delivers a page that was already downloaded, e.g. pushed from a
+// browser, into the target folder of the service
+func AddHTML(ctx context.Context, svc ReaderService, rawHTML string, pageURL string, opts AddOptions) *SyncSummary {
+	defer lockShared()()
+	// the config is read once for the whole sync
+	appConfig := GetAppConfig()
+
+	summary := newSyncSummary(svc.GetRemarkableConfig().Service, SyncOptions{DryRun: opts.DryRun})
+	rm := newDocumentWriter(appConfig.GetStorageLimits(), svc.GetRemarkableConfig(), SyncOptions{DryRun: opts.DryRun})
+
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		summary.addSkipped("", pageURL, "not a valid url")
+		return summary
+	}
+
+	doc, err := convertHTML(ctx, appConfig, rawHTML, u)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Could not convert article: %s (%s)", err, u))
+		summary.addSkipped("", u.String(), err.Error())
+		return summary
+	}
+
+	fileName := documentName(appConfig, doc.title, doc)
+	_, err = rm.writeDocument(fileName, doc)
+	if err != nil {
+		summary.addSkipped(doc.title, u.String(), fmt.Sprintf("could not write document: %s", err))
+		return summary
+	}
+	summary.addDocument(doc.title, u.String(), fileName, doc.fileType)
+
+	if opts.Save && !opts.DryRun && u.Host != "" {
+		err = svc.SaveURL(ctx, u, doc.title)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Could not save url to %s: %s", svc.GetRemarkableConfig().Service, err))
+		}
+	}
+
+	return summary
+}
+
+// ReadURLList reads one URL per line, ignoring empty lines and lines starting with #
+func ReadURLList(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+
+	return urls, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bmaupin/go-epub"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// chapter is a part of an article that becomes its own section in the epub
+type chapter struct {
+	title   string
+	content string
+	level   int // 1 for h1, 2 for h2, 0 for the part before the first heading
+	ids     []string
+}
+
+// articles shorter than this stay in one section, a page break before
+// every heading of a short article wastes more than the toc is worth
+const minChapteredWords = 1000
+
+const minLeadWords = 60
+
+var voidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true, atom.Embed: true, atom.Hr: true, atom.Img: true,
+	atom.Input: true, atom.Link: true, atom.Meta: true, atom.Source: true, atom.Track: true, atom.Wbr: true,
+}
+
+// splitChapters splits content before every h1 and h2. The elements a
+// heading is nested in are closed at the end of a chapter and opened again
+// at the start of the next one, so each chapter is complete on its own.
+func splitChapters(title string, content string) []chapter {
+	chapters := []chapter{{title: title}}
+	var current strings.Builder
+	var open []html.Token // elements open at this point, outermost first
+	var heading *html.Token
+	var headingText strings.Builder
+
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		token := z.Token()
+
+		switch tt {
+		case html.StartTagToken:
+			if (token.DataAtom == atom.H1 || token.DataAtom == atom.H2) && heading == nil {
+				// the article header and a short lead stay with the first chapter
+				if countWords(current.String()) >= minLeadWords || (len(chapters) > 1 && countWords(current.String()) > 0) {
+					for i := len(open) - 1; i >= 0; i-- {
+						current.WriteString("</" + open[i].Data + ">")
+					}
+					chapters[len(chapters)-1].content = current.String()
+					current.Reset()
+
+					level := 1
+					if token.DataAtom == atom.H2 {
+						level = 2
+					}
+					chapters = append(chapters, chapter{level: level})
+					for _, t := range open {
+						current.WriteString(withoutID(t).String())
+					}
+				}
+				heading = &token
+				headingText.Reset()
+			}
+			if id := attribute(token, "id"); id != "" {
+				chapters[len(chapters)-1].ids = append(chapters[len(chapters)-1].ids, id)
+			}
+			if !voidElements[token.DataAtom] {
+				open = append(open, token)
+			}
+		case html.SelfClosingTagToken:
+			if id := attribute(token, "id"); id != "" {
+				chapters[len(chapters)-1].ids = append(chapters[len(chapters)-1].ids, id)
+			}
+		case html.EndTagToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i].Data == token.Data {
+					open = open[:i]
+					break
+				}
+			}
+			if heading != nil && token.DataAtom == heading.DataAtom {
+				heading = nil
+				if c := &chapters[len(chapters)-1]; c.title == "" {
+					c.title = strings.Join(strings.Fields(headingText.String()), " ")
+				}
+			}
+		case html.TextToken:
+			if heading != nil {
+				headingText.WriteString(token.Data)
+			}
+		}
+		current.WriteString(raw)
+	}
+	chapters[len(chapters)-1].content = current.String()
+
+	// chapters are only named after their heading, an empty one falls back
+	// to the article's title
+	for i := range chapters {
+		if chapters[i].title == "" {
+			chapters[i].title = title
+		}
+	}
+	return chapters
+}
+
+func attribute(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func nodeAttribute(n *html.Node, name string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// withoutID is a reopened element, ids must stay unique
+func withoutID(token html.Token) html.Token {
+	var attrs []html.Attribute
+	for _, attr := range token.Attr {
+		if attr.Key != "id" {
+			attrs = append(attrs, attr)
+		}
+	}
+	token.Attr = attrs
+	return token
+}
+
+func chapterFilename(i int) string {
+	return fmt.Sprintf("chapter%03d.xhtml", i+1)
+}
+
+var fragmentLink = regexp.MustCompile(`href="#([^"]+)"`)
+
+// linkChapters points links to anchors in other chapters to their file
+func linkChapters(chapters []chapter) {
+	files := map[string]string{}
+	for i, c := range chapters {
+		for _, id := range c.ids {
+			files[id] = chapterFilename(i)
+		}
+	}
+
+	for i := range chapters {
+		own := chapterFilename(i)
+		chapters[i].content = fragmentLink.ReplaceAllStringFunc(chapters[i].content, func(link string) string {
+			id := html.UnescapeString(fragmentLink.FindStringSubmatch(link)[1])
+			if file, ok := files[id]; ok && file != own {
+				return fmt.Sprintf(`href="%s#%s"`, file, html.EscapeString(id))
+			}
+			return link
+		})
+	}
+}
+
+// addChapters adds the article as one section per h1 and h2, h2s following
+// an h1 become its subsections, so long reads get a navigable toc
+func addChapters(e *epub.Epub, title string, content string, cssPath string) {
+	chapters := []chapter{{title: title, content: content}}
+	if countWords(content) >= minChapteredWords {
+		chapters = splitChapters(title, content)
+		linkChapters(chapters)
+	}
+
+	parent, parentLevel := "", 0
+	for i, c := range chapters {
+		if parent != "" && c.level > parentLevel {
+			_, err := e.AddSubSection(parent, c.content, c.title, chapterFilename(i), cssPath)
+			if err == nil {
+				continue
+			}
+		}
+		_, _ = e.AddSection(c.content, c.title, chapterFilename(i), cssPath)
+		parent, parentLevel = chapterFilename(i), c.level
+		if c.level == 0 {
+			// the part before the first heading has no chapters of its own
+			parent = ""
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// leadParagraph is long enough to get a chapter of its own
+var leadParagraph = "<p>" + strings.Repeat("word ", minLeadWords) + "</p>"
+
+func TestSplitChapters(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		titles   []string
+		levels   []int
+		ids      [][]string
+		contents []string // checked when set
+	}{
+		{
+			name:    "h1 and h2",
+			content: leadParagraph + `<h1 id="one">One</h1><p>first</p><h2>Two</h2><p>second</p>`,
+			titles:  []string{"Article", "One", "Two"},
+			levels:  []int{0, 1, 2},
+			ids:     [][]string{nil, {"one"}, nil},
+			contents: []string{
+				leadParagraph,
+				`<h1 id="one">One</h1><p>first</p>`,
+				`<h2>Two</h2><p>second</p>`,
+			},
+		},
+		{
+			name:     "short leadParagraph stays with the first heading",
+			content:  `<p>short</p><h1>Heading</h1>` + leadParagraph + `<h2>Next</h2><p>text</p>`,
+			titles:   []string{"Article", "Next"},
+			levels:   []int{0, 2},
+			ids:      [][]string{nil, nil},
+			contents: []string{`<p>short</p><h1>Heading</h1>` + leadParagraph, `<h2>Next</h2><p>text</p>`},
+		},
+		{
+			name:    "nested heading",
+			content: `<div class="body" id="main"><section>` + leadParagraph + `<h2 id="nested">Nested</h2><p>inside</p></section></div>`,
+			titles:  []string{"Article", "Nested"},
+			levels:  []int{0, 2},
+			ids:     [][]string{{"main"}, {"nested"}},
+			contents: []string{
+				`<div class="body" id="main"><section>` + leadParagraph + `</section></div>`,
+				`<div class="body"><section><h2 id="nested">Nested</h2><p>inside</p></section></div>`,
+			},
+		},
+		{
+			name:    "void elements are not reopened",
+			content: `<div>` + leadParagraph + `<br><img src="a.png" id="figure"/><h2>After</h2></div>`,
+			titles:  []string{"Article", "After"},
+			levels:  []int{0, 2},
+			ids:     [][]string{{"figure"}, nil},
+			contents: []string{
+				`<div>` + leadParagraph + `<br><img src="a.png" id="figure"/></div>`,
+				`<div><h2>After</h2></div>`,
+			},
+		},
+		{
+			name:    "heading titles",
+			content: leadParagraph + "<h2>Two\n  <em>words</em></h2><p>a</p><h2> </h2><p>b</p>",
+			titles:  []string{"Article", "Two words", "Article"},
+			levels:  []int{0, 2, 2},
+			ids:     [][]string{nil, nil, nil},
+		},
+		{
+			name:    "no headings",
+			content: leadParagraph + leadParagraph,
+			titles:  []string{"Article"},
+			levels:  []int{0},
+			ids:     [][]string{nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chapters := splitChapters("Article", tt.content)
+
+			var titles, contents []string
+			var levels []int
+			var ids [][]string
+			for _, c := range chapters {
+				titles = append(titles, c.title)
+				levels = append(levels, c.level)
+				ids = append(ids, c.ids)
+				contents = append(contents, c.content)
+			}
+			if !reflect.DeepEqual(titles, tt.titles) {
+				t.Errorf("titles = %q, want %q", titles, tt.titles)
+			}
+			if !reflect.DeepEqual(levels, tt.levels) {
+				t.Errorf("levels = %v, want %v", levels, tt.levels)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("ids = %q, want %q", ids, tt.ids)
+			}
+			if tt.contents != nil && !reflect.DeepEqual(contents, tt.contents) {
+				t.Errorf("contents = %q, want %q", contents, tt.contents)
+			}
+		})
+	}
+}
+
+func TestLinkChapters(t *testing.T) {
+	chapters := []chapter{
+		{ids: []string{"top"}, content: `<p id="top"><a href="#sec">on</a> <a href="#top">up</a> <a href="#a&amp;b">escaped</a></p>`},
+		{ids: []string{"sec", "a&b"}, content: `<h2 id="sec">Sec</h2><a href="#top">back</a> <a href="#sec">self</a> <a href="#missing">gone</a> <a href="https://example.com/#top">other site</a>`},
+	}
+	linkChapters(chapters)
+
+	want := []string{
+		`<p id="top"><a href="chapter002.xhtml#sec">on</a> <a href="#top">up</a> <a href="chapter002.xhtml#a&amp;b">escaped</a></p>`,
+		`<h2 id="sec">Sec</h2><a href="chapter001.xhtml#top">back</a> <a href="#sec">self</a> <a href="#missing">gone</a> <a href="https://example.com/#top">other site</a>`,
+	}
+	for i := range chapters {
+		if chapters[i].content != want[i] {
+			t.Errorf("chapter %d = %q, want %q", i, chapters[i].content, want[i])
+		}
+	}
+}
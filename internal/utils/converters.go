@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/go-shiori/go-readability"
+)
+
+// fetched is a downloaded page whose content type was resolved from the
+// Content-Type header and the first bytes of the body
+type fetched struct {
+	url      *url.URL
+	mimeType string
+	body     io.Reader
+	resp     *http.Response
+	meta     articleMetadata
+}
+
+func (f *fetched) Close() error {
+	return f.resp.Body.Close()
+}
+
+// title is the service's title for files, which rarely have a useful name
+func (f *fetched) title() string {
+	if f.meta.Title != "" {
+		return f.meta.Title
+	}
+	return fileTitle(f.url)
+}
+
+// bytes read ahead to sniff the content type
+const sniffLength = 3072
+
+// fetchContent starts downloading u; the caller closes the result
+func fetchContent(ctx context.Context, u *url.URL) (*fetched, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	resp, err := doRequest(downloadClient, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("got response %d", resp.StatusCode)
+	}
+
+	body := bufio.NewReaderSize(resp.Body, sniffLength)
+	head, _ := body.Peek(sniffLength)
+	return &fetched{url: u, mimeType: contentType(resp.Header.Get("Content-Type"), head), body: body, resp: resp}, nil
+}
+
+// headContentType asks for the declared type of u without downloading it,
+// the type is empty when the server doesn't answer HEAD requests
+func headContentType(ctx context.Context, u *url.URL) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	resp, err := doRequest(downloadClient, req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", nil
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mimeType, nil
+}
+
+// types recognised by their magic bytes, whatever the server claims
+var binaryTypes = []string{"application/pdf", "application/epub+zip", "image/"}
+
+// contentType resolves the type of a body. Servers send PDFs as
+// application/octet-stream or even text/html, and error pages as
+// application/pdf, so magic bytes decide for binary types and the
+// Content-Type header for everything else.
+func contentType(header string, head []byte) string {
+	declared, _, _ := mime.ParseMediaType(header)
+	sniffed, _, _ := mime.ParseMediaType(mimetype.Detect(head).String())
+
+	if matchType(sniffed, binaryTypes...) || matchType(declared, binaryTypes...) {
+		return sniffed
+	}
+	if declared == "" || declared == "application/octet-stream" || declared == "binary/octet-stream" {
+		return sniffed
+	}
+	return declared
+}
+
+// matchType reports whether mimeType is one of types, a type ending in "/"
+// matches the whole group (e.g. "image/")
+func matchType(mimeType string, types ...string) bool {
+	for _, t := range types {
+		if mimeType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mimeType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// converter turns fetched content into a document the tablet can open
+type converter func(f *fetched, config *AppConfig) (document, error)
+
+// converters by content type, the first match is used
+var converters = []struct {
+	mimeType string
+	convert  converter
+}{
+	{"application/pdf", convertPDF},
+	{"application/epub+zip", convertEPUB},
+	{"text/html", convertReadable},
+	{"application/xhtml+xml", convertReadable},
+	{"text/plain", convertText},
+	{"image/", convertImage},
+}
+
+func isHTML(mimeType string) bool {
+	return matchType(mimeType, "text/html", "application/xhtml+xml")
+}
+
+func convertFetched(f *fetched, config *AppConfig) (document, error) {
+	for _, c := range converters {
+		if matchType(f.mimeType, c.mimeType) {
+			return c.convert(f, config)
+		}
+	}
+	return document{}, fmt.Errorf("no converter for content type %s", f.mimeType)
+}
+
+func convertPDF(f *fetched, config *AppConfig) (document, error) {
+	filePath, err := saveBody(f.body, f.resp.ContentLength, config.GetStorageLimits())
+	if err != nil {
+		return document{}, fmt.Errorf("could not download pdf: %w", err)
+	}
+
+	title := f.title()
+	if config.PDFCovers {
+		addPDFCover(f.resp.Request.Context(), filePath, title, f.meta)
+	}
+	return document{title: title, fileType: "pdf", path: filePath, meta: f.meta}, nil
+}
+
+// convertEPUB passes epubs through as they are
+func convertEPUB(f *fetched, config *AppConfig) (document, error) {
+	filePath, err := saveBody(f.body, f.resp.ContentLength, config.GetStorageLimits())
+	if err != nil {
+		return document{}, fmt.Errorf("could not download epub: %w", err)
+	}
+	return document{title: f.title(), fileType: "epub", path: filePath, meta: f.meta}, nil
+}
+
+func convertReadable(f *fetched, config *AppConfig) (document, error) {
+	content, err := readAll(f.body, config.GetStorageLimits().MaxDocumentSize)
+	if err != nil {
+		return document{}, fmt.Errorf("could not download page: %w", err)
+	}
+
+	article, err := readability.FromReader(bytes.NewReader(content), f.url)
+	if err != nil {
+		return document{}, fmt.Errorf("could not get readable article: %w", err)
+	}
+
+	meta := f.meta.fill(readabilityMetadata(article, f.url))
+	return newArticleDocument(f.resp.Request.Context(), config, article.Title, article.Content, meta)
+}
+
+// convertText turns each block of lines into a paragraph
+func convertText(f *fetched, config *AppConfig) (document, error) {
+	text, err := readAll(f.body, config.GetStorageLimits().MaxDocumentSize)
+	if err != nil {
+		return document{}, fmt.Errorf("could not download text: %w", err)
+	}
+
+	var content strings.Builder
+	for _, paragraph := range strings.Split(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(paragraph) == "" {
+			continue
+		}
+		content.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br/>") + "</p>\n")
+	}
+
+	title := f.title()
+	return newArticleDocument(f.resp.Request.Context(), config, title, content.String(), f.meta)
+}
+
+// convertImage wraps an image in an epub, prepared for the panel like the
+// images of articles
+func convertImage(f *fetched, config *AppConfig) (document, error) {
+	data, err := readAll(f.body, config.GetStorageLimits().MaxDocumentSize)
+	if err != nil {
+		return document{}, fmt.Errorf("could not download image: %w", err)
+	}
+
+	img, err := decodeImage(data, f.mimeType)
+	if err != nil {
+		return document{}, fmt.Errorf("could not decode image: %w", err)
+	}
+	dataURL, err := prepareImage(img, config.Images)
+	if err != nil {
+		return document{}, fmt.Errorf("could not convert image: %w", err)
+	}
+
+	title := f.title()
+	content := fmt.Sprintf(`<p><img src="%s" alt="%s"/></p>`, dataURL, html.EscapeString(title))
+	return newArticleDocument(f.resp.Request.Context(), config, title, content, f.meta)
+}
+
+// readAll reads r up to maxSize bytes, larger content is an
+// ErrDocumentTooLarge
+func readAll(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: more than %s", ErrDocumentTooLarge, formatSize(maxSize))
+	}
+	return data, nil
+}
@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmaupin/go-epub"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// coverInfo is what a generated cover shows
+type coverInfo struct {
+	title          string
+	site           string
+	authors        []string
+	saved          time.Time
+	readingMinutes int
+	image          image.Image
+}
+
+const (
+	// the reMarkable 2 screen
+	screenWidth  = 1404
+	screenHeight = 1872
+	coverMargin  = 110
+
+	wordsPerMinute   = 230
+	coverImageHeight = 720
+	maxImageSize     = 20 << 20
+)
+
+var (
+	coverFontsOnce sync.Once
+	coverRegular   *opentype.Font
+	coverBold      *opentype.Font
+	coverFontsErr  error
+)
+
+func loadCoverFonts() error {
+	coverFontsOnce.Do(func() {
+		coverRegular, coverFontsErr = opentype.Parse(goregular.TTF)
+		if coverFontsErr == nil {
+			coverBold, coverFontsErr = opentype.Parse(gobold.TTF)
+		}
+	})
+	return coverFontsErr
+}
+
+// newCoverInfo collects the cover of a document; the lead image is
+// downloaded, a cover without it is made when that fails
+func newCoverInfo(ctx context.Context, title string, meta articleMetadata, wordCount int) coverInfo {
+	info := coverInfo{title: title, site: articleSite(meta), authors: meta.Authors, saved: meta.Saved, readingMinutes: readingMinutes(wordCount)}
+	if meta.Image != "" {
+		info.image = loadCoverImage(ctx, meta.Image)
+	}
+	return info
+}
+
+func loadCoverImage(ctx context.Context, src string) image.Image {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil
+	}
+
+	img, err := downloadImage(ctx, u)
+	if err != nil {
+		fmt.Println("Could not download cover image:", err)
+		return nil
+	}
+	return img
+}
+
+func readingMinutes(wordCount int) int {
+	return (wordCount + wordsPerMinute - 1) / wordsPerMinute
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+func countWords(content string) int {
+	return len(strings.Fields(htmlTag.ReplaceAllString(content, " ")))
+}
+
+// renderCover draws the cover as a grayscale JPEG
+func renderCover(info coverInfo) ([]byte, error) {
+	err := loadCoverFonts()
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewGray(image.Rect(0, 0, screenWidth, screenHeight))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	textWidth := screenWidth - 2*coverMargin
+	gray := image.NewUniform(color.Gray{0x55})
+
+	y := coverMargin
+	if info.site != "" {
+		face := newFace(coverRegular, 44)
+		y = drawLines(img, face, wrapText(face, strings.ToUpper(info.site), textWidth, 1), y, gray)
+	}
+	draw.Draw(img, image.Rect(coverMargin, y+20, screenWidth-coverMargin, y+30), image.Black, image.Point{}, draw.Src)
+	y += 110
+
+	titleSize, titleLines := 100.0, 8
+	if info.image != nil && !info.image.Bounds().Empty() {
+		y = drawCoverImage(img, info.image, y) + 90
+		titleSize, titleLines = 80, 4
+	}
+
+	face := newFace(coverBold, titleSize)
+	y = drawLines(img, face, wrapText(face, info.title, textWidth, titleLines), y, image.Black) + 30
+
+	if len(info.authors) > 0 {
+		face := newFace(coverRegular, 52)
+		drawLines(img, face, wrapText(face, strings.Join(info.authors, ", "), textWidth, 2), y, image.Black)
+	}
+
+	var footer []string
+	if !info.saved.IsZero() {
+		footer = append(footer, "Saved "+info.saved.Format("2 January 2006"))
+	}
+	if info.readingMinutes > 0 {
+		footer = append(footer, fmt.Sprintf("%d min read", info.readingMinutes))
+	}
+	if len(footer) > 0 {
+		face := newFace(coverRegular, 44)
+		drawLines(img, face, []string{strings.Join(footer, "  ·  ")}, screenHeight-coverMargin-60, gray)
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	return buf.Bytes(), err
+}
+
+func newFace(f *opentype.Font, size float64) font.Face {
+	face, _ := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	return face
+}
+
+// drawCoverImage scales the image to the text width, cropping it to at most
+// coverImageHeight, and returns the y below it
+func drawCoverImage(dst *image.Gray, src image.Image, y int) int {
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return y
+	}
+	width := screenWidth - 2*coverMargin
+	height := bounds.Dy() * width / bounds.Dx()
+
+	if height > coverImageHeight {
+		// keep the middle of tall images
+		cropped := bounds.Dx() * coverImageHeight / width
+		top := bounds.Min.Y + (bounds.Dy()-cropped)/2
+		bounds = image.Rect(bounds.Min.X, top, bounds.Max.X, top+cropped)
+		height = coverImageHeight
+	}
+
+	target := image.Rect(coverMargin, y, coverMargin+width, y+height)
+	xdraw.CatmullRom.Scale(dst, target, src, bounds, xdraw.Over, nil)
+	return target.Max.Y
+}
+
+// wrapText breaks text into lines of at most width pixels, the last line
+// is shortened with an ellipsis when there are more than maxLines
+func wrapText(face font.Face, text string, width int, maxLines int) []string {
+	limit := fixed.I(width)
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := strings.TrimSpace(line + " " + word)
+		if line != "" && font.MeasureString(face, candidate) > limit {
+			lines = append(lines, line)
+			line = word
+		} else {
+			line = candidate
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		last := lines[maxLines-1]
+		for font.MeasureString(face, last+" …") > limit {
+			i := strings.LastIndex(last, " ")
+			if i < 0 {
+				break
+			}
+			last = last[:i]
+		}
+		lines[maxLines-1] = last + " …"
+	}
+	return lines
+}
+
+// drawLines draws lines from y on, which is the top of the first line, and
+// returns the y below the last one
+func drawLines(dst draw.Image, face font.Face, lines []string, y int, src image.Image) int {
+	metrics := face.Metrics()
+	lineHeight := (metrics.Ascent + metrics.Descent).Ceil() * 6 / 5
+
+	d := font.Drawer{Dst: dst, Src: src, Face: face}
+	for _, line := range lines {
+		d.Dot = fixed.P(coverMargin, y+metrics.Ascent.Ceil())
+		d.DrawString(line)
+		y += lineHeight
+	}
+	return y
+}
+
+// addEpubCover sets a generated cover, which the tablet's library shows
+// instead of a blank thumbnail
+func addEpubCover(ctx context.Context, config *AppConfig, e *epub.Epub, title string, meta articleMetadata, content string) {
+	if !config.GetCovers() {
+		return
+	}
+
+	wordCount := meta.WordCount
+	if wordCount == 0 {
+		wordCount = countWords(content)
+	}
+
+	cover, err := renderCover(newCoverInfo(ctx, title, meta, wordCount))
+	if err != nil {
+		fmt.Println("Could not generate cover:", err)
+		return
+	}
+
+	imagePath, err := e.AddImage("data:image/jpeg;base64,"+base64.StdEncoding.EncodeToString(cover), "cover.jpg")
+	if err != nil {
+		fmt.Println("Could not add cover:", err)
+		return
+	}
+	e.SetCover(imagePath, "")
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bmaupin/go-epub"
+)
+
+// digest collects the articles of a sync into a single epub instead of a
+// document each. Only epubs made from a page can be added, PDFs, epubs and
+// images are still delivered on their own, as are articles rendered as PDF.
+type digest struct {
+	started  time.Time
+	articles []document
+}
+
+func newDigest() *digest {
+	return &digest{started: time.Now()}
+}
+
+// add keeps doc for the digest, it reports false for documents that can't
+// be part of one
+func (d *digest) add(doc document) bool {
+	if doc.html == "" || doc.fileType != "epub" {
+		return false
+	}
+	d.articles = append(d.articles, doc)
+	return true
+}
+
+// title has the day in the configured time zone
+func (d *digest) title(config *AppConfig) string {
+	return "Reading — " + d.started.In(config.GetTimeZone()).Format("2006-01-02")
+}
+
+// write puts the digest on the tablet and returns its visible name, which
+// follows the name template like the names of single articles
+func (d *digest) write(ctx context.Context, config *AppConfig, rm documentWriter) (string, error) {
+	doc := d.document(ctx, config)
+	visibleName := documentName(config, doc.title, doc)
+	_, err := rm.writeDocument(visibleName, doc)
+	return visibleName, err
+}
+
+func (d *digest) document(ctx context.Context, config *AppConfig) document {
+	title := d.title(config)
+	meta := articleMetadata{Title: title, Publisher: fmt.Sprintf("%d articles", len(d.articles)), Saved: d.started}
+	for _, article := range d.articles {
+		meta.WordCount += article.meta.WordCount
+		if article.meta.WordCount == 0 {
+			meta.WordCount += countWords(article.html)
+		}
+	}
+
+	e := epub.NewEpub(title)
+	setEpubMetadata(e, meta)
+	addEpubCover(ctx, config, e, title, meta, "")
+	cssPath := addEpubStyle(e, config.GetStyle())
+
+	var contents strings.Builder
+	contents.WriteString(fmt.Sprintf("<h1>%s</h1>\n<ol>\n", html.EscapeString(title)))
+	for i, article := range d.articles {
+		contents.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a>`, digestSectionName(i), html.EscapeString(article.title)))
+		if site := articleSite(article.meta); site != "" {
+			contents.WriteString(" — " + html.EscapeString(site))
+		}
+		contents.WriteString("</li>\n")
+	}
+	contents.WriteString("</ol>\n")
+	_, _ = e.AddSection(contents.String(), "Contents", "contents.xhtml", cssPath)
+
+	for i, article := range d.articles {
+		_, _ = e.AddSection(addImages(e, article.html), article.title, digestSectionName(i), cssPath)
+	}
+
+	return document{title: title, fileType: "epub", content: epubFileContent(e, meta), meta: meta}
+}
+
+func digestSectionName(i int) string {
+	return fmt.Sprintf("article%03d.xhtml", i+1)
+}
+
+// articleSite is the publisher, or the host the article came from
+func articleSite(meta articleMetadata) string {
+	if meta.Publisher != "" {
+		return meta.Publisher
+	}
+	if u, err := url.Parse(meta.Source); err == nil {
+		return strings.TrimPrefix(u.Hostname(), "www.")
+	}
+	return ""
+}
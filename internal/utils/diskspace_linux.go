@@ -0,0 +1,13 @@
+package utils
+
+import "syscall"
+
+// freeSpace returns the space available to us on the filesystem holding dir
+func freeSpace(dir string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if syscall.Statfs(dir, &stat) != nil {
+		return 0, false
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package utils
+
+// freeSpace is only implemented for linux, which is what the tablet runs
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrInvalidEpub is an epub xochitl would refuse to open
+var ErrInvalidEpub = errors.New("invalid epub")
+
+// checkDocument looks at the structure of epubs before they are written, so
+// a broken one is reported instead of showing up as an empty document
+func checkDocument(doc document) error {
+	if doc.fileType != "epub" {
+		return nil
+	}
+
+	var err error
+	if doc.path != "" {
+		var r *zip.ReadCloser
+		r, err = zip.OpenReader(doc.path)
+		if err == nil {
+			err = checkEpub(&r.Reader)
+			_ = r.Close()
+		}
+	} else {
+		var r *zip.Reader
+		r, err = zip.NewReader(bytes.NewReader(doc.content), int64(len(doc.content)))
+		if err == nil {
+			err = checkEpub(r)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidEpub, err)
+	}
+	return nil
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Items []struct {
+		ID        string `xml:"id,attr"`
+		Href      string `xml:"href,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"manifest>item"`
+	Itemrefs []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// checkEpub checks that the mimetype, container and package document are
+// there, that everything in the manifest and spine exists and that the
+// XHTML files are well-formed with unique ids
+func checkEpub(r *zip.Reader) error {
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	mimetype, err := readZipFile(files, "mimetype")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(mimetype)) != "application/epub+zip" {
+		return fmt.Errorf("wrong mimetype %q", mimetype)
+	}
+
+	content, err := readZipFile(files, "META-INF/container.xml")
+	if err != nil {
+		return err
+	}
+	var container epubContainer
+	err = xml.Unmarshal(content, &container)
+	if err != nil {
+		return fmt.Errorf("META-INF/container.xml: %w", err)
+	}
+	if len(container.Rootfiles) == 0 {
+		return fmt.Errorf("META-INF/container.xml has no rootfile")
+	}
+
+	opfPath := container.Rootfiles[0].FullPath
+	content, err = readZipFile(files, opfPath)
+	if err != nil {
+		return err
+	}
+	var pkg epubPackage
+	err = xml.Unmarshal(content, &pkg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", opfPath, err)
+	}
+
+	items := map[string]string{}
+	for _, item := range pkg.Items {
+		href, err := url.PathUnescape(item.Href)
+		if err != nil {
+			return fmt.Errorf("%s: bad href %q", opfPath, item.Href)
+		}
+		name := path.Join(path.Dir(opfPath), href)
+		if files[name] == nil {
+			return fmt.Errorf("%s is in the manifest but missing", name)
+		}
+		items[item.ID] = name
+
+		if item.MediaType == "application/xhtml+xml" {
+			err = checkXHTML(files, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(pkg.Itemrefs) == 0 {
+		return fmt.Errorf("%s: the spine is empty", opfPath)
+	}
+	for _, itemref := range pkg.Itemrefs {
+		if items[itemref.IDRef] == "" {
+			return fmt.Errorf("%s: the spine refers to the unknown item %q", opfPath, itemref.IDRef)
+		}
+	}
+	return nil
+}
+
+// checkXHTML parses an XHTML file as XML; HTML entities are allowed, epubs
+// that declare the XHTML DTD may use them
+func checkXHTML(files map[string]*zip.File, name string) error {
+	content, err := readZipFile(files, name)
+	if err != nil {
+		return err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(content))
+	d.Entity = xml.HTMLEntity
+	ids := map[string]bool{}
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local != "id" || attr.Name.Space != "" {
+				continue
+			}
+			if ids[attr.Value] {
+				return fmt.Errorf("%s: duplicate id %q", name, attr.Value)
+			}
+			ids[attr.Value] = true
+		}
+	}
+}
+
+func readZipFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f := files[name]
+	if f == nil {
+		return nil, fmt.Errorf("%s is missing", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return content, nil
+}
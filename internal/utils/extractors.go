@@ -0,0 +1,335 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-shiori/dom"
+	"github.com/go-shiori/go-readability"
+	"golang.org/x/net/html"
+)
+
+// errNotExtracted lets an extractor hand a URL back to the generic
+// conversion, e.g. a github.com URL that is not a repository
+var errNotExtracted = errors.New("not handled by extractor")
+
+// extractor converts URLs of a site readability does badly on. The parsing is
+// kept apart from the fetching so it can be run on saved pages.
+type extractor struct {
+	name    string
+	match   func(u *url.URL) bool
+	extract func(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error)
+}
+
+var extractors = []extractor{
+	{"arxiv", matchArxiv, extractArxiv},
+	{"github", matchGithub, extractGithub},
+	{"wikipedia", matchWikipedia, extractWikipedia},
+	{"substack", matchSubstack, extractCleaned(substackClutter)},
+	{"medium", matchMedium, extractCleaned(mediumClutter)},
+}
+
+// extractURL runs the first matching extractor; ok is false when none
+// matched or it left the URL to the generic conversion
+func extractURL(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (doc document, ok bool, err error) {
+	for _, e := range extractors {
+		if !e.match(u) {
+			continue
+		}
+
+		doc, err = e.extract(ctx, config, u, meta)
+		if errors.Is(err, errNotExtracted) {
+			return document{}, false, nil
+		}
+		if err != nil {
+			return document{}, true, fmt.Errorf("%s: %w", e.name, err)
+		}
+		return doc, true, nil
+	}
+
+	return document{}, false, nil
+}
+
+func hostIs(u *url.URL, domain string) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// fetchHTML downloads and parses a page, other content types are an error
+func fetchHTML(ctx context.Context, u *url.URL) (*html.Node, error) {
+	f, err := fetchContent(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !isHTML(f.mimeType) {
+		return nil, fmt.Errorf("URL is not a HTML document: %s", f.mimeType)
+	}
+	return dom.Parse(f.body)
+}
+
+// absolutizeURLs resolves links and images against the page they came from,
+// which readability does for generic pages
+func absolutizeURLs(root *html.Node, base *url.URL) {
+	for _, attr := range []string{"href", "src"} {
+		for _, node := range dom.QuerySelectorAll(root, "["+attr+"]") {
+			ref, err := url.Parse(dom.GetAttribute(node, attr))
+			if err != nil || strings.HasPrefix(dom.GetAttribute(node, attr), "#") {
+				continue
+			}
+			dom.SetAttribute(node, attr, base.ResolveReference(ref).String())
+		}
+	}
+}
+
+func removeAll(root *html.Node, selectors []string) {
+	for _, selector := range selectors {
+		dom.RemoveNodes(dom.QuerySelectorAll(root, selector), nil)
+	}
+}
+
+// arXiv: abstract pages are delivered as the paper's PDF
+
+var arxivPath = regexp.MustCompile(`^/(?:abs|pdf)/(.+?)(?:\.pdf)?$`)
+
+func matchArxiv(u *url.URL) bool {
+	return hostIs(u, "arxiv.org") && arxivPath.MatchString(u.Path)
+}
+
+func extractArxiv(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error) {
+	id := arxivPath.FindStringSubmatch(u.Path)[1]
+	absURL := &url.URL{Scheme: "https", Host: "arxiv.org", Path: "/abs/" + id}
+	pdfURL := &url.URL{Scheme: "https", Host: "arxiv.org", Path: "/pdf/" + id}
+
+	abs, err := fetchHTML(ctx, absURL)
+	if err != nil {
+		return document{}, fmt.Errorf("could not get abstract page: %w", err)
+	}
+	absMeta := parseArxivAbs(abs)
+
+	f, err := fetchContent(ctx, pdfURL)
+	if err != nil {
+		return document{}, fmt.Errorf("could not download pdf: %w", err)
+	}
+	defer f.Close()
+
+	// the paper's own data is better than what was saved with the link
+	f.meta = absMeta.fill(meta)
+	return convertPDF(f, config)
+}
+
+// parseArxivAbs reads the citation meta tags of an abstract page
+func parseArxivAbs(abs *html.Node) articleMetadata {
+	citation := func(name string) string {
+		if node := dom.QuerySelector(abs, `meta[name="citation_`+name+`"]`); node != nil {
+			return dom.GetAttribute(node, "content")
+		}
+		return ""
+	}
+
+	meta := articleMetadata{Title: citation("title"), Description: citation("abstract"), Publisher: "arXiv", Language: "en"}
+	for _, node := range dom.QuerySelectorAll(abs, `meta[name="citation_author"]`) {
+		meta.Authors = append(meta.Authors, dom.GetAttribute(node, "content"))
+	}
+	meta.Published, _ = time.Parse("2006/01/02", citation("date"))
+
+	return meta
+}
+
+// GitHub: repositories are delivered as their rendered README
+
+func matchGithub(u *url.URL) bool {
+	return strings.ToLower(u.Hostname()) == "github.com" && len(githubRepo(u)) == 2
+}
+
+func githubRepo(u *url.URL) []string {
+	return strings.Split(strings.Trim(u.Path, "/"), "/")
+}
+
+func extractGithub(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error) {
+	repo := githubRepo(u)
+	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/readme", url.PathEscape(repo[0]), url.PathEscape(repo[1]))
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	req.Header.Set("Accept", "application/vnd.github.html")
+	resp, err := doRequest(httpClient, req)
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		// the API's limit doesn't apply to the page, which is converted
+		// like any other
+		return document{}, errNotExtracted
+	}
+	if err != nil {
+		return document{}, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// not a repository (e.g. github.com/features/actions) or no README
+		return document{}, errNotExtracted
+	}
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		// rate limited, the API allows 60 requests an hour without a token
+		return document{}, errNotExtracted
+	}
+	if resp.StatusCode != 200 {
+		return document{}, fmt.Errorf("got response %d", resp.StatusCode)
+	}
+
+	readme, err := dom.Parse(io.LimitReader(resp.Body, config.GetStorageLimits().MaxDocumentSize))
+	if err != nil {
+		return document{}, err
+	}
+
+	title, content := parseGithubReadme(readme, u)
+	meta = articleMetadata{Authors: []string{repo[0]}, Publisher: "GitHub"}.fill(meta)
+	return newArticleDocument(ctx, config, title, content, meta)
+}
+
+// parseGithubReadme takes the README as rendered by the GitHub API
+func parseGithubReadme(readme *html.Node, u *url.URL) (string, string) {
+	title := strings.Join(githubRepo(u), "/")
+
+	// the anchor icons next to each heading
+	removeAll(readme, []string{"a.anchor", "svg"})
+	absolutizeURLs(readme, &url.URL{Scheme: "https", Host: "github.com", Path: "/" + title + "/blob/HEAD/"})
+	for _, img := range dom.QuerySelectorAll(readme, "img[src]") {
+		dom.SetAttribute(img, "src", strings.Replace(dom.GetAttribute(img, "src"), "/"+title+"/blob/", "/"+title+"/raw/", 1))
+	}
+
+	body := dom.QuerySelector(readme, "body")
+	if body == nil {
+		return title, ""
+	}
+	return title, dom.InnerHTML(body)
+}
+
+// Wikipedia: articles come from the REST API's mobile-html, which has no
+// navigation or sidebars to strip
+
+func matchWikipedia(u *url.URL) bool {
+	return hostIs(u, "wikipedia.org") && strings.HasPrefix(u.Path, "/wiki/")
+}
+
+func extractWikipedia(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error) {
+	hostParts := strings.Split(u.Hostname(), ".")
+	language := hostParts[0]
+	page := strings.TrimPrefix(u.EscapedPath(), "/wiki/")
+	if len(hostParts) < 3 || strings.Contains(page, ":") {
+		// special pages, talk pages, files...
+		return document{}, errNotExtracted
+	}
+
+	apiURL, err := url.Parse(fmt.Sprintf("https://%s.wikipedia.org/api/rest_v1/page/mobile-html/%s", language, page))
+	if err != nil {
+		return document{}, err
+	}
+	mobile, err := fetchHTML(ctx, apiURL)
+	if err != nil {
+		return document{}, err
+	}
+
+	title, content := parseWikipediaMobile(mobile, u)
+	meta = articleMetadata{Authors: []string{"Wikipedia contributors"}, Publisher: "Wikipedia", Language: language}.fill(meta)
+	return newArticleDocument(ctx, config, title, content, meta)
+}
+
+var wikipediaClutter = []string{
+	"script", "style", "link", "meta",
+	".pcs-edit-section-link-container", ".pcs-collapse-table-collapsed-container",
+	".pcs-collapse-table-collapsed-bottom", ".noprint", ".mw-empty-elt",
+}
+
+// parseWikipediaMobile turns the mobile-html of an article into plain
+// sections, loading the images that the app would load lazily
+func parseWikipediaMobile(mobile *html.Node, u *url.URL) (string, string) {
+	var title string
+	if node := dom.QuerySelector(mobile, "title"); node != nil {
+		title = strings.TrimSpace(dom.TextContent(node))
+	}
+	if title == "" {
+		title = strings.ReplaceAll(strings.TrimPrefix(u.Path, "/wiki/"), "_", " ")
+	}
+
+	removeAll(mobile, wikipediaClutter)
+	for _, placeholder := range dom.QuerySelectorAll(mobile, "span.pcs-lazy-load-placeholder") {
+		img := dom.CreateElement("img")
+		dom.SetAttribute(img, "src", dom.GetAttribute(placeholder, "data-src"))
+		dom.SetAttribute(img, "alt", dom.GetAttribute(placeholder, "data-alt"))
+		dom.ReplaceChild(placeholder.Parent, img, placeholder)
+	}
+	absolutizeURLs(mobile, &url.URL{Scheme: "https", Host: u.Host, Path: "/wiki/"})
+
+	body := dom.QuerySelector(mobile, "body")
+	if body == nil {
+		return title, ""
+	}
+	return title, dom.InnerHTML(body)
+}
+
+// Substack and Medium: readability finds the article, but keeps the
+// subscribe boxes, share buttons and clap counters around it. Publications
+// on their own domain are not recognised by URL.
+
+func matchSubstack(u *url.URL) bool {
+	return hostIs(u, "substack.com")
+}
+
+func matchMedium(u *url.URL) bool {
+	return hostIs(u, "medium.com")
+}
+
+var substackClutter = []string{
+	".subscription-widget-wrap", ".subscribe-widget", "[data-component-name=SubscribeWidgetToDOM]",
+	".button-wrapper", ".share-dialog", ".post-footer", ".post-ufi", ".paywall",
+	".captioned-button-wrap", ".footer-wrap",
+}
+
+var mediumClutter = []string{
+	".speechify-ignore", "[data-testid=headerClapButton]", "[data-testid=audioPlayButton]",
+	"[aria-label=responses]", "[aria-label=Share]", ".pw-multi-vote-icon", "footer",
+}
+
+func extractCleaned(clutter []string) func(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error) {
+	return func(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error) {
+		page, err := fetchHTML(ctx, u)
+		if err != nil {
+			return document{}, err
+		}
+
+		article, err := readability.FromDocument(cleanPage(page, clutter), u)
+		if err != nil {
+			return document{}, fmt.Errorf("could not get readable article: %w", err)
+		}
+
+		meta = meta.fill(readabilityMetadata(article, u))
+		return newArticleDocument(ctx, config, article.Title, article.Content, meta)
+	}
+}
+
+// cleanPage removes clutter before readability looks at the page. Images
+// Medium only sets in <picture> sources get a src so they are kept.
+func cleanPage(page *html.Node, clutter []string) *html.Node {
+	removeAll(page, clutter)
+
+	for _, img := range dom.QuerySelectorAll(page, "picture img:not([src])") {
+		source := dom.QuerySelector(img.Parent, "source[srcset]")
+		if source == nil {
+			continue
+		}
+		srcset := strings.Fields(dom.GetAttribute(source, "srcset"))
+		if len(srcset) > 0 {
+			dom.SetAttribute(img, "src", srcset[0])
+		}
+	}
+
+	return page
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-shiori/dom"
+	"golang.org/x/net/html"
+)
+
+func loadPage(t *testing.T, name string) *html.Node {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	page, err := dom.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestParseArxivAbs(t *testing.T) {
+	meta := parseArxivAbs(loadPage(t, "arxiv-abs.html"))
+
+	if meta.Title != "Attention Is All You Need" {
+		t.Errorf("title = %q", meta.Title)
+	}
+	wantAuthors := []string{"Vaswani, Ashish", "Shazeer, Noam", "Parmar, Niki"}
+	if !reflect.DeepEqual(meta.Authors, wantAuthors) {
+		t.Errorf("authors = %q, want %q", meta.Authors, wantAuthors)
+	}
+	if !meta.Published.Equal(time.Date(2017, 6, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("published = %v", meta.Published)
+	}
+	if !strings.HasPrefix(meta.Description, "The dominant sequence transduction models") {
+		t.Errorf("description = %q", meta.Description)
+	}
+	if meta.Publisher != "arXiv" || meta.Language != "en" {
+		t.Errorf("publisher = %q, language = %q", meta.Publisher, meta.Language)
+	}
+}
+
+func TestParseGithubReadme(t *testing.T) {
+	u := mustParseURL(t, "https://github.com/nov1n/pocket2rm")
+	title, content := parseGithubReadme(loadPage(t, "github-readme.html"), u)
+
+	if title != "nov1n/pocket2rm" {
+		t.Errorf("title = %q", title)
+	}
+	for _, want := range []string{
+		"<h1",
+		"Sync articles from Pocket to the reMarkable.",
+		`src="https://github.com/nov1n/pocket2rm/raw/HEAD/docs/screenshot.png"`,
+		`href="https://github.com/nov1n/pocket2rm/blob/HEAD/docs/install.md"`,
+		`href="https://remarkable.guide/"`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content does not contain %q:\n%s", want, content)
+		}
+	}
+	for _, unwanted := range []string{"<svg", `class="anchor"`} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("content contains %q:\n%s", unwanted, content)
+		}
+	}
+}
+
+func TestParseWikipediaMobile(t *testing.T) {
+	u := mustParseURL(t, "https://en.wikipedia.org/wiki/E_Ink")
+	title, content := parseWikipediaMobile(loadPage(t, "wikipedia-mobile.html"), u)
+
+	if title != "E Ink" {
+		t.Errorf("title = %q", title)
+	}
+	for _, want := range []string{
+		"is a brand of",
+		`<img src="https://upload.wikimedia.org/wikipedia/commons/thumb/a/a9/Eink.jpg/220px-Eink.jpg" alt="An e-reader showing text"/>`,
+		`href="https://en.wikipedia.org/wiki/Electronic_paper"`,
+		`href="#cite_note-1"`,
+		"History",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content does not contain %q:\n%s", want, content)
+		}
+	}
+	for _, unwanted := range []string{"<script", "<style", "<link", "pcs-lazy-load-placeholder", "pcs-edit-section-link", "edit on Wikidata", "mw-empty-elt"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("content contains %q:\n%s", unwanted, content)
+		}
+	}
+}
+
+func TestParseWikipediaMobileTitleFromURL(t *testing.T) {
+	page, err := dom.Parse(strings.NewReader("<html><body><p>text</p></body></html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	title, _ := parseWikipediaMobile(page, mustParseURL(t, "https://de.wikipedia.org/wiki/Elektronisches_Papier"))
+	if title != "Elektronisches Papier" {
+		t.Errorf("title = %q", title)
+	}
+}
+
+func TestCleanPage(t *testing.T) {
+	tests := []struct {
+		page      string
+		clutter   []string
+		want      []string
+		unwanted  []string
+		imageSrcs []string
+	}{
+		{
+			page:     "substack.html",
+			clutter:  substackClutter,
+			want:     []string{"Saving articles is easy", "A tablet that gets them every night"},
+			unwanted: []string{"Subscribe to get new posts", "Subscribe now", "12 likes", "© 2024 Example"},
+		},
+		{
+			page:      "medium.html",
+			clutter:   mediumClutter,
+			want:      []string{"After years of reading on screens", "My desk"},
+			unwanted:  []string{"Listen", "Share", "1.2K", "Help Status About Careers"},
+			imageSrcs: []string{"https://miro.medium.com/v2/resize:fit:640/format:webp/1*abc.png"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.page, func(t *testing.T) {
+			page := cleanPage(loadPage(t, tt.page), tt.clutter)
+			text := dom.TextContent(page)
+
+			for _, want := range tt.want {
+				if !strings.Contains(text, want) {
+					t.Errorf("page does not contain %q", want)
+				}
+			}
+			for _, unwanted := range tt.unwanted {
+				if strings.Contains(text, unwanted) {
+					t.Errorf("page contains %q", unwanted)
+				}
+			}
+
+			var srcs []string
+			for _, img := range dom.QuerySelectorAll(page, "img") {
+				srcs = append(srcs, dom.GetAttribute(img, "src"))
+			}
+			if !reflect.DeepEqual(srcs, tt.imageSrcs) {
+				t.Errorf("image srcs = %q, want %q", srcs, tt.imageSrcs)
+			}
+		})
+	}
+}
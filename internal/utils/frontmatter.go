@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+)
+
+// frontMatter is what the article header and footer templates can show
+type frontMatter struct {
+	Title       string
+	Authors     []string
+	Site        string
+	Published   time.Time
+	Saved       time.Time
+	ReadingTime int // minutes
+	Tags        []string
+	Source      string
+}
+
+// defaultFrontMatter defines the "header" and "footer" templates; a
+// template file set in the config can redefine either of them
+const defaultFrontMatter = `{{define "header"}}<h1>{{.Title}}</h1>
+{{if .Authors}}<p><strong>{{join .Authors ", "}}</strong></p>
+{{end}}{{if or .Site (not .Published.IsZero) .ReadingTime}}<p>{{.Site}}{{if not .Published.IsZero}}{{if .Site}} · {{end}}{{date .Published}}{{end}}{{if .ReadingTime}}{{if or .Site (not .Published.IsZero)}} · {{end}}{{.ReadingTime}} min read{{end}}</p>
+{{end}}{{if .Source}}<p><a href="{{.Source}}">{{.Source}}</a></p>
+{{end}}{{end}}{{define "footer"}}{{if or .Tags (not .Saved.IsZero)}}<hr/>
+<p>{{if not .Saved.IsZero}}Saved {{date .Saved}}{{end}}{{if .Tags}}{{if not .Saved.IsZero}} · {{end}}{{join .Tags ", "}}{{end}}</p>
+{{end}}{{end}}`
+
+// newFrontMatterTemplate parses the built-in templates; a template can't be
+// redefined once it was executed, so every article gets a new one
+func newFrontMatterTemplate() *template.Template {
+	return template.Must(template.New("frontMatter").Funcs(template.FuncMap{
+		"join": strings.Join,
+		"date": func(t time.Time) string { return t.Format("2 January 2006") },
+	}).Parse(defaultFrontMatter))
+}
+
+// loadFrontMatterTemplate parses the user's template file at path on top of
+// the built-in templates
+func loadFrontMatterTemplate(path string) *template.Template {
+	if path == "" {
+		return newFrontMatterTemplate()
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println("Could not read article template, using the default one:", err)
+		return newFrontMatterTemplate()
+	}
+	custom, err := newFrontMatterTemplate().Parse(string(content))
+	if err != nil {
+		fmt.Println("Could not parse article template, using the default one:", err)
+		return newFrontMatterTemplate()
+	}
+	return custom
+}
+
+func renderFrontMatter(tmpl *template.Template, data frontMatter) (string, string, error) {
+	var header, footer bytes.Buffer
+	err := tmpl.ExecuteTemplate(&header, "header", data)
+	if err == nil {
+		err = tmpl.ExecuteTemplate(&footer, "footer", data)
+	}
+	return header.String(), footer.String(), err
+}
+
+// withFrontMatter puts the header and footer around the content of an
+// article
+func withFrontMatter(templatePath string, title string, meta articleMetadata, content string) string {
+	wordCount := meta.WordCount
+	if wordCount == 0 {
+		wordCount = countWords(content)
+	}
+	data := frontMatter{
+		Title:       title,
+		Authors:     meta.Authors,
+		Site:        articleSite(meta),
+		Published:   meta.Published,
+		Saved:       meta.Saved,
+		ReadingTime: readingMinutes(wordCount),
+		Tags:        meta.Tags,
+		Source:      meta.Source,
+	}
+
+	header, footer, err := renderFrontMatter(loadFrontMatterTemplate(templatePath), data)
+	if err != nil {
+		fmt.Println("Could not render article template, using the default one:", err)
+		header, footer, _ = renderFrontMatter(newFrontMatterTemplate(), data)
+	}
+	return header + content + footer
+}
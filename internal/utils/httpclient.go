@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RateLimitError is returned instead of waiting when a service asks us to
+// back off for longer than rateLimitMaxWait
+type RateLimitError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limited until %s", e.Host, e.Until.Format("2006-01-02 15:04:05"))
+}
+
+const (
+	retryMaxAttempts = 4
+	retryBaseDelay   = time.Second
+	retryMaxDelay    = 30 * time.Second
+	rateLimitMaxWait = time.Minute
+)
+
+var (
+	httpClient     = &http.Client{Timeout: 30 * time.Second}
+	downloadClient = &http.Client{Timeout: 5 * time.Minute}
+
+	// hosts that told us to stop sending requests, and until when
+	rateLimits   = map[string]time.Time{}
+	rateLimitsMu sync.Mutex
+)
+
+// doRequest sends the request with client, retrying transient failures
+// (connection errors, timeouts, 5xx) with jittered exponential backoff and
+// pausing while the host is rate limited. Request bodies are replayed
+// through req.GetBody, which http.NewRequest sets for in-memory bodies.
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	for attempt := 0; ; attempt++ {
+		err := waitForRateLimit(req.Context(), host)
+		if err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if !isTransient(err) || attempt+1 == retryMaxAttempts || req.Context().Err() != nil {
+				return nil, err
+			}
+			fmt.Println(fmt.Sprintf("request to %s failed (%s), retrying", host, err))
+			err = sleepContext(req.Context(), backoff(attempt))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if until, limited := rateLimitedUntil(resp); limited {
+			setRateLimit(host, until)
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusServiceUnavailable {
+				resp.Body.Close()
+				if attempt+1 == retryMaxAttempts {
+					return nil, &RateLimitError{host, until}
+				}
+				continue
+			}
+		}
+
+		if resp.StatusCode >= 500 && attempt+1 < retryMaxAttempts {
+			resp.Body.Close()
+			fmt.Println(fmt.Sprintf("request to %s got response %d, retrying", host, resp.StatusCode))
+			err = sleepContext(req.Context(), backoff(attempt))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay))) + delay/2
+}
+
+func isTransient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// rateLimitedUntil understands Retry-After (omnivore, most sites) and
+// pocket's X-Limit-User-*/X-Limit-Key-* headers
+func rateLimitedUntil(resp *http.Response) (time.Time, bool) {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter := resp.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Now().Add(time.Duration(seconds) * time.Second), true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return date, true
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return time.Now().Add(rateLimitMaxWait), true
+		}
+	}
+
+	for _, limit := range []string{"User", "Key"} {
+		if resp.Header.Get("X-Limit-"+limit+"-Remaining") != "0" {
+			continue
+		}
+		seconds, err := strconv.Atoi(resp.Header.Get("X-Limit-" + limit + "-Reset"))
+		if err == nil {
+			return time.Now().Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func setRateLimit(host string, until time.Time) {
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+	rateLimits[host] = until
+}
+
+// waitForRateLimit sleeps out short rate limits and gives up on long ones
+func waitForRateLimit(ctx context.Context, host string) error {
+	rateLimitsMu.Lock()
+	until := rateLimits[host]
+	rateLimitsMu.Unlock()
+
+	wait := time.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+	if wait > rateLimitMaxWait {
+		return &RateLimitError{host, until}
+	}
+
+	fmt.Println(fmt.Sprintf("%s is rate limited, waiting %s", host, wait.Round(time.Second)))
+	return sleepContext(ctx, wait)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
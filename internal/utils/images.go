@@ -0,0 +1,379 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bmaupin/go-epub"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ImageConfig controls how images are prepared for the grayscale panel
+type ImageConfig struct {
+	Embed    *bool   `yaml:"embed,omitempty"`    // download images into the epub, default true
+	Dither   bool    `yaml:"dither,omitempty"`   // dither to the 16 grays of the panel
+	Contrast float64 `yaml:"contrast,omitempty"` // e.g. 1.2 for more contrast, default 1
+}
+
+func (c ImageConfig) GetEmbed() bool {
+	return c.Embed == nil || *c.Embed
+}
+
+const (
+	// images downloaded at once per article
+	imageConcurrency = 4
+	maxArticleImages = 100
+	// images smaller than this are tracking pixels or spacers
+	minImageSize = 8
+	jpegQuality  = 80
+	grayLevels   = 16
+	// images are scaled down to the screen anyway; a decoded image of three
+	// screens takes about 30 MB, and up to imageConcurrency are decoded at
+	// once on a tablet with little memory to spare
+	maxImagePixels = 3 * screenWidth * screenHeight
+)
+
+var (
+	errUnsupportedImage = errors.New("unsupported image format")
+	errImageTooLarge    = errors.New("image too large")
+)
+
+// downloadImage downloads and decodes an image; SVGs are rasterized, AVIF
+// has no decoder in Go and is reported as unsupported
+func downloadImage(ctx context.Context, u *url.URL) (image.Image, error) {
+	f, err := fetchContent(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := readAll(f.body, maxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(data, f.mimeType)
+}
+
+func decodeImage(data []byte, mimeType string) (image.Image, error) {
+	switch {
+	case mimeType == "image/svg+xml" || (mimeType == "text/xml" || mimeType == "application/xml") && bytes.Contains(data, []byte("<svg")):
+		return rasterizeSVG(data)
+	case mimeType == "image/avif" || mimeType == "image/heic" || mimeType == "image/heif":
+		return nil, fmt.Errorf("%w: %s", errUnsupportedImage, mimeType)
+	case len(data) > 12 && string(data[4:8]) == "ftyp" && strings.HasPrefix(string(data[8:12]), "avi"):
+		// not recognised by the mimetype version in use
+		return nil, fmt.Errorf("%w: image/avif", errUnsupportedImage)
+	}
+
+	// the header tells the size before anything is allocated for the pixels
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedImage, mimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d", errImageTooLarge, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedImage, mimeType)
+	}
+	return img, err
+}
+
+// rasterizeSVG draws an SVG at its own size, scaled up or down to fit the
+// screen
+func rasterizeSVG(data []byte) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		return nil, fmt.Errorf("svg without a size")
+	}
+
+	scale := 1.0
+	if icon.ViewBox.W < screenWidth/2 {
+		// small icons and diagrams would be blurry when the reader scales them up
+		scale = screenWidth / 2 / icon.ViewBox.W
+	}
+	w, h := fitScreen(int(icon.ViewBox.W*scale), int(icon.ViewBox.H*scale))
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img, nil
+}
+
+// fitScreen scales a size down, never up, to fit the screen
+func fitScreen(w int, h int) (int, int) {
+	if w > screenWidth {
+		w, h = screenWidth, h*screenWidth/w
+	}
+	if h > screenHeight {
+		w, h = w*screenHeight/h, screenHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// processImage prepares an image for the panel: transparent parts become
+// white, it is scaled down to the screen, made gray, its contrast adjusted
+// and optionally dithered
+func processImage(src image.Image, cfg ImageConfig) *image.Gray {
+	bounds := src.Bounds()
+	w, h := fitScreen(bounds.Dx(), bounds.Dy())
+
+	// scaled over white straight from src, a copy at full size would take
+	// as much memory again
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(gray, gray.Bounds(), image.White, image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(gray, gray.Bounds(), src, bounds, draw.Over, nil)
+
+	if cfg.Contrast > 0 && cfg.Contrast != 1 {
+		for i, v := range gray.Pix {
+			gray.Pix[i] = clampGray((float64(v)-128)*cfg.Contrast + 128)
+		}
+	}
+	if cfg.Dither {
+		ditherGray(gray)
+	}
+	return gray
+}
+
+func clampGray(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// ditherGray reduces the image to the panel's grays with Floyd-Steinberg
+// error diffusion, which keeps gradients from turning into bands
+func ditherGray(img *image.Gray) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	step := 255.0 / (grayLevels - 1)
+
+	current, next := make([]float64, w+2), make([]float64, w+2)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*img.Stride + x
+			v := float64(img.Pix[i]) + current[x+1]
+			quantized := math.Min(math.Max(math.Round(v/step)*step, 0), 255)
+			img.Pix[i] = clampGray(quantized)
+
+			e := v - quantized
+			current[x+2] += e * 7 / 16
+			next[x] += e * 3 / 16
+			next[x+1] += e * 5 / 16
+			next[x+2] += e * 1 / 16
+		}
+		current, next = next, current
+		for i := range next {
+			next[i] = 0
+		}
+	}
+}
+
+// encodeImage keeps images that are mostly a few grays (diagrams,
+// screenshots, dithered images) lossless as PNG, photos become JPEGs
+func encodeImage(img *image.Gray) ([]byte, string, error) {
+	var histogram [256]int
+	for _, v := range img.Pix {
+		histogram[v]++
+	}
+	counts := histogram[:]
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+	common := 0
+	for _, count := range counts[:grayLevels] {
+		common += count
+	}
+
+	var buf bytes.Buffer
+	// the rest are the edges of antialiased lines and text
+	if common*100 >= len(img.Pix)*97 {
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err := encoder.Encode(&buf, img)
+		return buf.Bytes(), "image/png", err
+	}
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	return buf.Bytes(), "image/jpeg", err
+}
+
+// prepareImage turns a downloaded image into a data URL of the processed
+// image
+func prepareImage(img image.Image, cfg ImageConfig) (string, error) {
+	if img.Bounds().Dx() < minImageSize || img.Bounds().Dy() < minImageSize {
+		return "", fmt.Errorf("image too small")
+	}
+
+	data, mimeType, err := encodeImage(processImage(img, cfg))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// inlineImages downloads the images of an article and replaces them with
+// data URLs of the processed images; images that can't be used are
+// replaced by their alt text. The data URLs are kept in the document's
+// XHTML, so a digest doesn't download them again, and are moved into the
+// epub by addImages.
+func inlineImages(ctx context.Context, cfg ImageConfig, content string, base *url.URL) string {
+	if !cfg.GetEmbed() {
+		return content
+	}
+
+	var sources []string
+	seen := map[string]bool{}
+	z := html.NewTokenizer(strings.NewReader(content))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		token := z.Token()
+		if token.DataAtom != atom.Img {
+			continue
+		}
+		src := imageSource(token, base)
+		if src != "" && !strings.HasPrefix(src, "data:") && !seen[src] && len(sources) < maxArticleImages {
+			seen[src] = true
+			sources = append(sources, src)
+		}
+	}
+	if len(sources) == 0 {
+		return content
+	}
+
+	dataURLs := map[string]string{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, imageConcurrency)
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			u, _ := url.Parse(src)
+			img, err := downloadImage(ctx, u)
+			if err == nil {
+				var dataURL string
+				dataURL, err = prepareImage(img, cfg)
+				if err == nil {
+					mutex.Lock()
+					dataURLs[src] = dataURL
+					mutex.Unlock()
+					return
+				}
+			}
+			fmt.Println(fmt.Sprintf("Could not embed image %s: %s", src, err))
+		}(src)
+	}
+	wg.Wait()
+
+	var out strings.Builder
+	z = html.NewTokenizer(strings.NewReader(content))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		raw := string(z.Raw())
+		token := z.Token()
+		if token.DataAtom != atom.Img || (tt != html.StartTagToken && tt != html.SelfClosingTagToken) {
+			out.WriteString(raw)
+			continue
+		}
+
+		src := imageSource(token, base)
+		if strings.HasPrefix(src, "data:") {
+			out.WriteString(raw)
+			continue
+		}
+		dataURL, ok := dataURLs[src]
+		if !ok {
+			if alt := strings.TrimSpace(attribute(token, "alt")); alt != "" {
+				out.WriteString("<em>" + html.EscapeString(alt) + "</em>")
+			}
+			continue
+		}
+
+		var attrs []html.Attribute
+		for _, attr := range token.Attr {
+			// the other sizes of a responsive image are remote too, and the
+			// size of the original no longer applies
+			if attr.Key != "src" && attr.Key != "srcset" && attr.Key != "sizes" && attr.Key != "width" && attr.Key != "height" && attr.Key != "loading" {
+				attrs = append(attrs, attr)
+			}
+		}
+		token.Attr = append(attrs, html.Attribute{Key: "src", Val: dataURL})
+		token.Type = html.SelfClosingTagToken
+		out.WriteString(token.String())
+	}
+	return out.String()
+}
+
+// imageSource is the absolute URL of an img, data URLs are returned as
+// they are
+func imageSource(token html.Token, base *url.URL) string {
+	src := strings.TrimSpace(attribute(token, "src"))
+	if src == "" || strings.HasPrefix(src, "data:") || base == nil {
+		return src
+	}
+	u, err := base.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+var dataImage = regexp.MustCompile(`src="(data:image/(jpeg|png|gif|webp|svg\+xml);base64,[^"]+)"`)
+
+// addImages moves the images inlined as data URLs into files of the epub;
+// an image used twice is stored once
+func addImages(e *epub.Epub, content string) string {
+	return dataImage.ReplaceAllStringFunc(content, func(attr string) string {
+		match := dataImage.FindStringSubmatch(attr)
+		extension := "." + strings.TrimSuffix(match[2], "+xml")
+		name := fmt.Sprintf("%x%s", sha1.Sum([]byte(match[1])), extension)
+
+		imagePath, err := e.AddImage(match[1], name)
+		var usedErr *epub.FilenameAlreadyUsedError
+		if errors.As(err, &usedErr) {
+			imagePath = path.Join("..", "images", name)
+		} else if err != nil {
+			fmt.Println("Could not add image:", err)
+			return attr
+		}
+		return fmt.Sprintf(`src="%s"`, imagePath)
+	})
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// links after this many are kept as plain text, a QR code for each of
+	// hundreds of links only makes the epub large
+	maxLinkNotes = 100
+	qrCodeSize   = 300
+)
+
+// linkNotes turns the links of an article into numbered notes, listed with
+// a QR code each in a References section at the end, so they can be opened
+// with a phone. The link to the source, which the article header starts
+// with, keeps its place and gets a QR code too.
+func linkNotes(content string, source string) string {
+	base, _ := url.Parse(source)
+	source = linkTarget(source, nil)
+	var notes []string
+	numbers := map[string]int{}
+	sourceDone := false
+
+	var out strings.Builder
+	var inNote, inSource, inDropped bool
+	var note int
+	z := html.NewTokenizer(strings.NewReader(content))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		raw := string(z.Raw())
+		token := z.Token()
+		if token.DataAtom != atom.A {
+			out.WriteString(raw)
+			continue
+		}
+
+		if tt == html.EndTagToken {
+			switch {
+			case inNote:
+				out.WriteString(fmt.Sprintf(`<sup><a href="#note-%d">[%d]</a></sup>`, note, note))
+			case inSource:
+				out.WriteString(raw)
+				if qr := qrCodeImage(source, "QR code of the source"); qr != "" {
+					out.WriteString("<br/>" + qr)
+				}
+			case inDropped:
+				// its start tag was dropped too
+			default:
+				out.WriteString(raw)
+			}
+			inNote, inSource, inDropped = false, false, false
+			continue
+		}
+
+		href := linkTarget(attribute(token, "href"), base)
+		switch {
+		case href == "":
+			out.WriteString(raw)
+		case href == source && !sourceDone:
+			sourceDone, inSource = true, true
+			out.WriteString(raw)
+		case numbers[href] > 0:
+			inNote, note = true, numbers[href]
+		case len(notes) < maxLinkNotes:
+			notes = append(notes, href)
+			numbers[href] = len(notes)
+			inNote, note = true, len(notes)
+		default:
+			// the text stays, without the link
+			inDropped = true
+		}
+	}
+
+	if len(notes) == 0 {
+		return out.String()
+	}
+
+	out.WriteString("\n<h2>References</h2>\n<ol>\n")
+	for i, href := range notes {
+		out.WriteString(fmt.Sprintf(`<li id="note-%d"><p>%s</p>%s</li>`+"\n", i+1, html.EscapeString(href), qrCodeImage(href, fmt.Sprintf("QR code of link %d", i+1))))
+	}
+	out.WriteString("</ol>\n")
+	return out.String()
+}
+
+// linkTarget is the absolute URL of a link to another page, links within
+// the article and mailto: links give ""
+func linkTarget(href string, base *url.URL) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return ""
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// qrCodeImage is an img of the QR code of u, as a data URL that addImages
+// moves into the epub
+func qrCodeImage(u string, alt string) string {
+	png, err := qrcode.Encode(u, qrcode.Low, qrCodeSize)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Could not create QR code for %s: %s", u, err))
+		return ""
+	}
+	return fmt.Sprintf(`<img class="qr" src="data:image/png;base64,%s" alt="%s"/>`, base64.StdEncoding.EncodeToString(png), alt)
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+func lockPath() string {
+	return filepath.Join(getUserHomeDir(), ".pocket2rm.lock")
+}
+
+// lockShared is held by every sync and push while it downloads and writes
+// documents; it blocks while RecoverInterruptedWrites holds the lock and
+// returns the function that releases it
+func lockShared() func() {
+	f, err := os.OpenFile(lockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		fmt.Println("Could not open lock file:", err)
+		return func() {}
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		fmt.Println("Could not lock:", err)
+	}
+	return func() { _ = f.Close() }
+}
+
+// tryLockExclusive gets the lock only when no other sync or push is using
+// the staging and download folders
+func tryLockExclusive() (func(), bool) {
+	f, err := os.OpenFile(lockPath(), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		fmt.Println("Could not open lock file:", err)
+		return nil, false
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		return nil, false
+	}
+	return func() { _ = f.Close() }, true
+}
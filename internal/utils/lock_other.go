@@ -0,0 +1,12 @@
+//go:build !linux
+
+package utils
+
+// locking is only implemented for linux, which is what the tablet runs
+func lockShared() func() {
+	return func() {}
+}
+
+func tryLockExclusive() (func(), bool) {
+	return func() {}, true
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bmaupin/go-epub"
+	"github.com/go-shiori/go-readability"
+)
+
+// articleMetadata describes a document and where it came from. It ends up in
+// the epub and the .content file, so the tablet's library and search show
+// real authors and sources.
+type articleMetadata struct {
+	Title       string // the title the service has, used for files without one
+	Authors     []string
+	Published   time.Time
+	Description string
+	Language    string
+	Source      string // the article's URL
+	Publisher   string
+	Image       string // a lead image, if the source has one
+	Saved       time.Time
+	WordCount   int
+	Tags        []string // the service's tags or labels
+}
+
+// fill sets the empty fields of m from other; the service's own data is
+// usually better than what is guessed from the page
+func (m articleMetadata) fill(other articleMetadata) articleMetadata {
+	if m.Title == "" {
+		m.Title = other.Title
+	}
+	if len(m.Authors) == 0 {
+		m.Authors = other.Authors
+	}
+	if m.Published.IsZero() {
+		m.Published = other.Published
+	}
+	if m.Description == "" {
+		m.Description = other.Description
+	}
+	if m.Language == "" {
+		m.Language = other.Language
+	}
+	if m.Source == "" {
+		m.Source = other.Source
+	}
+	if m.Publisher == "" {
+		m.Publisher = other.Publisher
+	}
+	if m.Image == "" {
+		m.Image = other.Image
+	}
+	if m.Saved.IsZero() {
+		m.Saved = other.Saved
+	}
+	if m.WordCount == 0 {
+		m.WordCount = other.WordCount
+	}
+	if len(m.Tags) == 0 {
+		m.Tags = other.Tags
+	}
+	return m
+}
+
+func readabilityMetadata(article readability.Article, u *url.URL) articleMetadata {
+	var authors []string
+	if byline := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(article.Byline), "By ")); byline != "" {
+		authors = []string{byline}
+	}
+
+	return articleMetadata{
+		Authors:     authors,
+		Description: strings.TrimSpace(article.Excerpt),
+		Language:    article.Language,
+		Source:      u.String(),
+		Publisher:   article.SiteName,
+		Image:       article.Image,
+	}
+}
+
+// setEpubMetadata sets what go-epub supports directly, the rest is added by
+// addOPFMetadata once the epub is written
+func setEpubMetadata(e *epub.Epub, meta articleMetadata) {
+	if len(meta.Authors) > 0 {
+		e.SetAuthor(strings.Join(meta.Authors, ", "))
+	}
+	if meta.Description != "" {
+		e.SetDescription(meta.Description)
+	}
+	if meta.Language != "" {
+		e.SetLang(meta.Language)
+	}
+	if meta.Source != "" {
+		e.SetIdentifier(meta.Source)
+	}
+}
+
+const opfName = "EPUB/package.opf"
+
+// addOPFMetadata adds dc:date, dc:publisher and dc:source, which go-epub has
+// no setters for, to the package document of a written epub
+func addOPFMetadata(epubContent []byte, meta articleMetadata) ([]byte, error) {
+	var elements strings.Builder
+	if !meta.Published.IsZero() {
+		elements.WriteString(fmt.Sprintf("  <dc:date>%s</dc:date>\n  ", meta.Published.UTC().Format("2006-01-02")))
+	}
+	if meta.Publisher != "" {
+		elements.WriteString(fmt.Sprintf("  <dc:publisher>%s</dc:publisher>\n  ", html.EscapeString(meta.Publisher)))
+	}
+	if meta.Source != "" {
+		elements.WriteString(fmt.Sprintf("  <dc:source>%s</dc:source>\n  ", html.EscapeString(meta.Source)))
+	}
+	if elements.Len() == 0 {
+		return epubContent, nil
+	}
+
+	return rewriteEpubFile(epubContent, opfName, func(opf []byte) []byte {
+		return bytes.Replace(opf, []byte("</metadata>"), []byte(elements.String()+"</metadata>"), 1)
+	})
+}
+
+// rewriteEpubFile copies the epub, changing one file; the order of the
+// entries (mimetype first, uncompressed) is kept
+func rewriteEpubFile(epubContent []byte, name string, rewrite func([]byte) []byte) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(epubContent), int64(len(epubContent)))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range r.File {
+		if f.Name != name {
+			err = w.Copy(f)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: f.Method, Modified: f.Modified})
+		if err != nil {
+			return nil, err
+		}
+		_, err = fw.Write(rewrite(content))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	// zone names work on the tablet, which has no zoneinfo
+	_ "time/tzdata"
+)
+
+const (
+	// xochitl cuts names off in the library, long titles only make the
+	// interesting part disappear
+	maxTitleLength = 80
+	maxNameLength  = 150
+)
+
+// defaultNameTemplate sorts documents by the time they were saved
+const defaultNameTemplate = `{{date .Saved "20060102-1504"}} :: {{.Title}}`
+
+// nameData is what the document name template can show
+type nameData struct {
+	Title       string
+	Authors     []string
+	Site        string
+	Published   time.Time
+	Saved       time.Time
+	ReadingTime int // minutes
+	Tags        []string
+}
+
+func parseNameTemplate(text string) (*template.Template, error) {
+	return template.New("name").Funcs(template.FuncMap{
+		"join": strings.Join,
+		"date": func(t time.Time, layout string) string { return t.Format(layout) },
+	}).Parse(text)
+}
+
+// documentName is the name doc gets in the tablet's library; title is the
+// one the service has, which may be better than the page's
+func documentName(config *AppConfig, title string, doc document) string {
+	loc := config.GetTimeZone()
+	meta := doc.meta
+	wordCount := meta.WordCount
+	if wordCount == 0 {
+		wordCount = countWords(doc.html)
+	}
+	data := nameData{
+		Title:       truncateName(cleanName(title), maxTitleLength),
+		Authors:     meta.Authors,
+		Site:        articleSite(meta),
+		Published:   meta.Published.In(loc),
+		Saved:       meta.Saved.In(loc),
+		ReadingTime: readingMinutes(wordCount),
+		Tags:        meta.Tags,
+	}
+
+	name, err := renderName(config.GetNameTemplate(), data)
+	if err != nil {
+		fmt.Println("Could not render name template, using the default one:", err)
+		name, _ = renderName(defaultNameTemplate, data)
+	}
+	if name == "" {
+		name = data.Title
+	}
+	return name
+}
+
+func renderName(text string, data nameData) (string, error) {
+	tmpl, err := parseNameTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var name bytes.Buffer
+	err = tmpl.Execute(&name, data)
+	if err != nil {
+		return "", err
+	}
+	return truncateName(cleanName(name.String()), maxNameLength), nil
+}
+
+// cleanName turns control characters, e.g. newlines from a title, into
+// spaces and collapses runs of whitespace
+func cleanName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncateName(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
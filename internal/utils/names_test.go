@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDocumentName(t *testing.T) {
+	saved := time.Date(2026, 10, 17, 22, 30, 0, 0, time.UTC)
+	meta := articleMetadata{
+		Authors:   []string{"Ada", "Grace"},
+		Source:    "https://www.example.com/post",
+		Saved:     saved,
+		Published: time.Date(2026, 10, 1, 23, 0, 0, 0, time.UTC),
+		WordCount: 1000,
+		Tags:      []string{"long", "read"},
+	}
+
+	tests := []struct {
+		name   string
+		config AppConfig
+		title  string
+		meta   articleMetadata
+		want   string
+	}{
+		{
+			name:   "default template",
+			config: AppConfig{TimeZone: "UTC"},
+			title:  "A title",
+			meta:   meta,
+			want:   "20261017-2230 :: A title",
+		},
+		{
+			name:   "time zone",
+			config: AppConfig{TimeZone: "Pacific/Auckland"},
+			title:  "A title",
+			meta:   meta,
+			want:   "20261018-1130 :: A title",
+		},
+		{
+			name:   "published in the time zone",
+			config: AppConfig{TimeZone: "Europe/Berlin", NameTemplate: `{{date .Published "2006-01-02"}} {{.Title}}`},
+			title:  "A title",
+			meta:   meta,
+			want:   "2026-10-02 A title",
+		},
+		{
+			name:   "all fields",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Site}}: {{.Title}} ({{join .Authors ", "}}, {{.ReadingTime}} min, {{join .Tags "/"}})`},
+			title:  "A title",
+			meta:   meta,
+			want:   "example.com: A title (Ada, Grace, 5 min, long/read)",
+		},
+		{
+			name:   "publisher as site",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Site}}: {{.Title}}`},
+			title:  "A title",
+			meta:   articleMetadata{Publisher: "GitHub", Source: "https://github.com/a/b"},
+			want:   "GitHub: A title",
+		},
+		{
+			name:   "template that doesn't parse",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Title`},
+			title:  "A title",
+			meta:   meta,
+			want:   "20261017-2230 :: A title",
+		},
+		{
+			name:   "template that fails",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Missing}}`},
+			title:  "A title",
+			meta:   meta,
+			want:   "20261017-2230 :: A title",
+		},
+		{
+			name:   "empty name",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{if .Tags}}{{end}}`},
+			title:  "A title",
+			meta:   meta,
+			want:   "A title",
+		},
+		{
+			name:   "cleaned title",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Title}}`},
+			title:  "  A\ntitle\t with   spaces\u0000 ",
+			meta:   meta,
+			want:   "A title with spaces",
+		},
+		{
+			name:   "truncated title",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Title}}!`},
+			title:  strings.Repeat("é", 100),
+			meta:   meta,
+			want:   strings.Repeat("é", maxTitleLength-1) + "…!",
+		},
+		{
+			name:   "truncated name",
+			config: AppConfig{TimeZone: "UTC", NameTemplate: `{{.Title}}{{.Title}}`},
+			title:  strings.Repeat("a", 78) + " b",
+			meta:   meta,
+			want:   strings.Repeat("a", 78) + " b" + strings.Repeat("a", maxNameLength-81) + "…",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := documentName(&tt.config, tt.title, document{meta: tt.meta})
+			if name != tt.want {
+				t.Errorf("name = %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentNameReadingTimeFromContent(t *testing.T) {
+	config := &AppConfig{NameTemplate: `{{.ReadingTime}} min`}
+	doc := document{html: "<p>" + strings.Repeat("word ", wordsPerMinute+1) + "</p>"}
+
+	if name := documentName(config, "A title", doc); name != "2 min" {
+		t.Errorf("name = %q", name)
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly 10", 10, "exactly 10"},
+		{"one word too many", 10, "one word…"},
+		{"ümläüte ïn nämes", 8, "ümläüte…"},
+	}
+
+	for _, tt := range tests {
+		if got := truncateName(tt.s, tt.max); got != tt.want {
+			t.Errorf("truncateName(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}
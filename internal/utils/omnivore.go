@@ -2,13 +2,17 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-shiori/dom"
+	"github.com/google/uuid"
 	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -24,8 +28,51 @@ type OmnivoreConfig struct {
 	Username         string `yaml:"username"`
 	ApiKey           string `yaml:"apiKey"`
 	Query            string `yaml:"query"`
-	HandledLabel     string `json:"handledLabel"`
-	SkippedLabel     string `json:"skippedLabel"`
+	HandledLabel     string `yaml:"handledLabel" json:"handledLabel"` // default "remarkable"
+	SkippedLabel     string `yaml:"skippedLabel" json:"skippedLabel"` // default "remarkable-skipped"
+	// replaces the shared style for documents from omnivore
+	Style  *StyleConfig `yaml:"style,omitempty"`
+	Format string       `yaml:"format,omitempty"` // replaces the shared format, "epub" or "pdf"
+}
+
+// UnmarshalYAML also reads the label keys configs had before the fields got
+// yaml tags, the next time the config is written they are replaced
+func (c *OmnivoreConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain OmnivoreConfig
+	err := value.Decode((*plain)(c))
+	if err != nil {
+		return err
+	}
+
+	var old struct {
+		HandledLabel string `yaml:"handledlabel"`
+		SkippedLabel string `yaml:"skippedlabel"`
+	}
+	err = value.Decode(&old)
+	if err != nil {
+		return err
+	}
+	if c.HandledLabel == "" {
+		c.HandledLabel = old.HandledLabel
+	}
+	if c.SkippedLabel == "" {
+		c.SkippedLabel = old.SkippedLabel
+	}
+	return nil
+}
+
+func (c OmnivoreConfig) GetHandledLabel() string {
+	if c.HandledLabel == "" {
+		return "remarkable"
+	}
+	return c.HandledLabel
+}
+
+func (c OmnivoreConfig) GetSkippedLabel() string {
+	if c.SkippedLabel == "" {
+		return "remarkable-skipped"
+	}
+	return c.SkippedLabel
 }
 
 type searchPayloadVariables struct {
@@ -44,6 +91,11 @@ type omnivoreItem struct {
 	SavedAt     time.Time       `json:"savedAt"`
 	URL         *url.URL        `json:"url"`
 	Labels      []omnivoreLabel `json:"labels"`
+	Description string          `json:"description"`
+	SiteName    string          `json:"siteName"`
+	Language    string          `json:"language"`
+	Image       string          `json:"image"`
+	WordsCount  int             `json:"wordsCount"`
 }
 
 type searchResultData struct {
@@ -72,6 +124,11 @@ type searchResultNode struct {
 	SavedAt     string          `json:"savedAt"`
 	URL         string          `json:"url"`
 	Labels      []omnivoreLabel `json:"labels"`
+	Description string          `json:"description"`
+	SiteName    string          `json:"siteName"`
+	Language    string          `json:"language"`
+	Image       string          `json:"image"`
+	WordsCount  int             `json:"wordsCount"`
 }
 
 type omnivoreLabel struct {
@@ -91,6 +148,23 @@ type LabelResultLabelList struct {
 	Labels []omnivoreLabel `json:"labels"`
 }
 
+type createLabelResultData struct {
+	Data createLabelResultCreateLabel `json:"data"`
+}
+
+type createLabelResultCreateLabel struct {
+	CreateLabel createLabelResult `json:"createLabel"`
+}
+
+type createLabelResult struct {
+	Label      omnivoreLabel `json:"label"`
+	ErrorCodes []string      `json:"errorCodes"`
+}
+
+type createLabelVariables struct {
+	Input createLabelInput `json:"input"`
+}
+
 type omnivorePayload struct {
 	Query     string      `json:"query"`
 	Variables interface{} `json:"variables"`
@@ -143,6 +217,34 @@ type setLabelsVariablesInput struct {
 	LabelIds []string `json:"labelIds"`
 }
 
+type saveUrlResultData struct {
+	Data saveUrlResultSaveUrl `json:"data"`
+}
+
+type saveUrlResultSaveUrl struct {
+	SaveUrl saveUrlResult `json:"saveUrl"`
+}
+
+type saveUrlResult struct {
+	Url        string   `json:"url"`
+	ErrorCodes []string `json:"errorCodes"`
+}
+
+type saveUrlVariables struct {
+	Input saveUrlVariablesInput `json:"input"`
+}
+
+type saveUrlVariablesInput struct {
+	Url             string             `json:"url"`
+	Source          string             `json:"source"`
+	ClientRequestId string             `json:"clientRequestId"`
+	Labels          []createLabelInput `json:"labels,omitempty"`
+}
+
+type createLabelInput struct {
+	Name string `json:"name"`
+}
+
 func (s OmnivoreService) GetRemarkableConfig() *RemarkableConfig {
 	return &RemarkableConfig{
 		Service:          s.Name,
@@ -151,60 +253,234 @@ func (s OmnivoreService) GetRemarkableConfig() *RemarkableConfig {
 	}
 }
 
-func (s OmnivoreService) GenerateFiles(maxArticles uint) error {
+func (s OmnivoreService) GenerateFiles(ctx context.Context, opts SyncOptions) (*SyncSummary, error) {
+	defer lockShared()()
+	// the config is read once for the whole sync
+	appConfig := GetAppConfig()
+
 	config := s.Config
 
 	fmt.Println("inside generateFiles (omnivore)")
-	rm := Remarkable{Config: s.GetRemarkableConfig()}
-	searchResults, err := s.getSearchResults()
+	summary := newSyncSummary(s.Name, opts)
+	rm := newDocumentWriter(appConfig.GetStorageLimits(), s.GetRemarkableConfig(), opts)
+
+	searchResults, err := s.getSearchResults(ctx)
 	if err != nil {
 		fmt.Println("Could not get omnivore articles: ", err)
-		return err
+		summary.noteError(err)
+		return summary, err
+	}
+
+	// fetched once, labels created along the way are added to it
+	labels, err := s.getLabelList(ctx)
+	if err != nil {
+		fmt.Println("Could not get list of labels: ", err)
+		summary.noteError(err)
+		return summary, err
+	}
+
+	registerHandled := func(article omnivoreItem, label string) error {
+		return s.registerHandled(context.Background(), article, label, labels)
+	}
+	if opts.DryRun {
+		registerHandled = func(article omnivoreItem, label string) error {
+			fmt.Println(fmt.Sprintf("dry-run: would add label '%s' to %s", label, article.Id))
+			return nil
+		}
+	}
+
+	// articles that went into the digest are labeled once it is written
+	var d *digest
+	var inDigest []omnivoreItem
+	if opts.Digest {
+		d = newDigest()
 	}
 
 	var processed uint = 0
-	for _, searchResult := range searchResults {
-		fileName := getFilename(searchResult.SavedAt, searchResult.Title)
-		extension := filepath.Ext(searchResult.URL.String())
-		fmt.Println(fileName, extension)
-		if extension == ".pdf" {
-			fileContent := createPDFFileContent(searchResult.URL.String())
-			rm.generatePDF(fileName, fileContent)
+	convert := func(i int) (document, error) {
+		return s.convertItem(ctx, appConfig, searchResults[i])
+	}
+	convertInOrder(ctx, len(searchResults), opts.Concurrency, convert, func(i int, doc document, err error) bool {
+		searchResult := searchResults[i]
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Could not convert article: %s (%s)", err, searchResult.URL))
+			summary.addSkipped(searchResult.Title, searchResult.URL.String(), err.Error())
+			summary.noteError(err)
+			if errors.Is(err, ErrNotEnoughSpace) {
+				// left unlabeled, the next ones would not fit either
+				return false
+			}
+			// a rate limited site is tried again next sync
+			var rateLimitErr *RateLimitError
+			if !errors.As(err, &rateLimitErr) {
+				summary.noteError(registerHandled(searchResult, config.GetSkippedLabel()))
+			}
+			return true
+		}
+
+		if d != nil && d.add(doc) {
+			inDigest = append(inDigest, searchResult)
 		} else {
-			article, err := s.getArticleContent(searchResult.Slug)
+			fileName := documentName(appConfig, searchResult.Title, doc)
+			_, err = rm.writeDocument(fileName, doc)
+			if errors.Is(err, ErrDocumentTooLarge) || errors.Is(err, ErrInvalidEpub) {
+				summary.addSkipped(searchResult.Title, searchResult.URL.String(), err.Error())
+				summary.noteError(registerHandled(searchResult, config.GetSkippedLabel()))
+				return true
+			}
 			if err != nil {
-				fmt.Println(fmt.Sprintf("Could not get readable article: %s (%s)", err, searchResult.URL))
-				s.registerHandled(searchResult, config.SkippedLabel)
-				continue
+				// left unlabeled, so it is tried again next sync
+				summary.addSkipped(searchResult.Title, searchResult.URL.String(), fmt.Sprintf("could not write document: %s", err))
+				return false
 			}
-			fileContent := createEpubFileContent(article.Title, article.Content, article.Author)
-			rm.generateEpub(fileName, fileContent)
+			summary.addDocument(searchResult.Title, searchResult.URL.String(), fileName, doc.fileType)
+			summary.noteError(registerHandled(searchResult, config.GetHandledLabel()))
 		}
 
-		s.registerHandled(searchResult, config.HandledLabel)
 		processed++
-		fmt.Println(fmt.Sprintf("progress: %d/%d", processed, maxArticles))
-		if processed == maxArticles {
+		fmt.Println(fmt.Sprintf("progress: %d/%d", processed, opts.MaxArticles))
+		return opts.MaxArticles == 0 || processed < opts.MaxArticles
+	})
+
+	if len(inDigest) > 0 {
+		visibleName, err := d.write(ctx, appConfig, rm)
+		for _, searchResult := range inDigest {
+			if err != nil {
+				summary.addSkipped(searchResult.Title, searchResult.URL.String(), fmt.Sprintf("could not write digest: %s", err))
+				continue
+			}
+			summary.addDocument(searchResult.Title, searchResult.URL.String(), visibleName, "epub")
+			summary.noteError(registerHandled(searchResult, config.GetHandledLabel()))
+		}
+	}
+
+	summary.finish(ctx)
+	return summary, nil
+}
+
+// convertItem converts PDFs, epubs and other files by their content type and
+// turns pages into an epub from the content omnivore already parsed
+func (s OmnivoreService) convertItem(ctx context.Context, config *AppConfig, item omnivoreItem) (document, error) {
+	meta := item.metadata()
+	doc, ok, err := extractURL(ctx, config, item.URL, meta)
+	if ok {
+		return doc, err
+	}
+
+	// pages omnivore already parsed only get a HEAD request, other files are
+	// downloaded and recognised by their first bytes; a page that can't be
+	// downloaded anymore is still in omnivore
+	mimeType, err := headContentType(ctx, item.URL)
+	if err == nil && !isHTML(mimeType) {
+		f, err := fetchContent(ctx, item.URL)
+		if err == nil {
+			defer f.Close()
+			f.meta = meta
+			if !isHTML(f.mimeType) {
+				return convertFetched(f, config)
+			}
+		}
+	}
+
+	article, err := s.getArticleContent(ctx, item.Slug)
+	if err != nil {
+		return document{}, fmt.Errorf("could not get article content: %w", err)
+	}
+	return newArticleDocument(ctx, config, article.Title, article.Content, meta)
+}
+
+func (item omnivoreItem) metadata() articleMetadata {
+	var authors []string
+	if item.Author != "" {
+		authors = []string{item.Author}
+	}
+	var tags []string
+	for _, label := range item.Labels {
+		tags = append(tags, label.Name)
+	}
+
+	return articleMetadata{
+		Title:       item.Title,
+		Authors:     authors,
+		Published:   item.PublishedAt,
+		Description: item.Description,
+		Language:    item.Language,
+		Source:      item.URL.String(),
+		Publisher:   item.SiteName,
+		Image:       item.Image,
+		Saved:       item.SavedAt,
+		WordCount:   item.WordsCount,
+		Tags:        tags,
+	}
+}
+
+func (s OmnivoreService) Queue(ctx context.Context, maxArticles uint) ([]QueueItem, error) {
+	searchResults, err := s.getSearchResults(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var queue []QueueItem
+	for _, searchResult := range searchResults {
+		if uint(len(queue)) == maxArticles {
 			break
 		}
+		queue = append(queue, QueueItem{searchResult.Title, searchResult.URL.String(), searchResult.SavedAt})
+	}
+
+	return queue, nil
+}
+
+// SaveURL saves the URL to omnivore with the handled label already set, so
+// the next sync does not deliver it a second time
+func (s OmnivoreService) SaveURL(ctx context.Context, u *url.URL, title string) error {
+	config := s.Config
+
+	retrieveResult := &saveUrlResultData{}
+
+	query := "mutation SaveUrl($input: SaveUrlInput!) { saveUrl(input: $input) { ... on SaveSuccess { url clientRequestId } ... on SaveError { errorCodes message } } }"
+	variables := saveUrlVariables{
+		saveUrlVariablesInput{
+			Url:             u.String(),
+			Source:          "api",
+			ClientRequestId: uuid.New().String(),
+		},
 	}
+	variables.Input.Labels = []createLabelInput{{Name: config.GetHandledLabel()}}
 
+	resp, err := s.omnivoreRequest(ctx, query, variables)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(retrieveResult)
+	if err != nil {
+		return err
+	}
+
+	if len(retrieveResult.Data.SaveUrl.ErrorCodes) > 0 {
+		return fmt.Errorf("could not save url: %s", strings.Join(retrieveResult.Data.SaveUrl.ErrorCodes, ", "))
+	}
+
+	fmt.Println(fmt.Sprintf("Saved '%s' to omnivore", retrieveResult.Data.SaveUrl.Url))
 	return nil
 }
 
-func (s OmnivoreService) registerHandled(article omnivoreItem, label string) bool {
+func (s OmnivoreService) registerHandled(ctx context.Context, article omnivoreItem, label string, labels map[string]string) error {
 	fmt.Println("Marking article as handled")
 
-	// TODO: Only get label list once per session
-	labelList, err := s.getLabelList()
+	labelId, err := s.ensureLabel(ctx, labels, label)
 	if err != nil {
-		fmt.Println("Could not get list of labels, skipping...")
-		return false
+		fmt.Println(fmt.Sprintf("Could not create label '%s', skipping...", label))
+		return err
 	}
-	labelId := labelList[label]
-	articleLabels := article.Labels
+
 	var updatedLabelList []string
-	for _, articleLabel := range articleLabels {
+	for _, articleLabel := range article.Labels {
+		if articleLabel.Id == labelId {
+			return nil
+		}
 		updatedLabelList = append(updatedLabelList, articleLabel.Id)
 	}
 	updatedLabelList = append(updatedLabelList, labelId)
@@ -219,39 +495,80 @@ func (s OmnivoreService) registerHandled(article omnivoreItem, label string) boo
 		},
 	}
 
-	resp, err := s.omnivoreRequest(query, variables)
+	resp, err := s.omnivoreRequest(ctx, query, variables)
 	if err != nil {
 		fmt.Println("Could not update article labels")
-		return false
+		return err
+	}
+
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(retrieveResult)
+	if err != nil {
+		return err
+	}
+
+	for _, articleLabel := range retrieveResult.Data.SetLabels.Labels {
+		if articleLabel.Name == label {
+			fmt.Println(fmt.Sprintf("Added label '%s' to article", label))
+			return nil
+		}
+	}
+
+	return fmt.Errorf("could not add label '%s' to article", label)
+}
+
+// ensureLabel returns the id of the label, creating it in omnivore (and in
+// labels) if it does not exist yet
+func (s OmnivoreService) ensureLabel(ctx context.Context, labels map[string]string, name string) (string, error) {
+	if labelId, ok := labels[name]; ok {
+		return labelId, nil
+	}
+
+	fmt.Println(fmt.Sprintf("Creating label '%s'", name))
+	retrieveResult := &createLabelResultData{}
+
+	query := "mutation CreateLabel($input: CreateLabelInput!) { createLabel(input: $input) { ... on CreateLabelSuccess { label { id name } } ... on CreateLabelError { errorCodes } } }"
+	variables := createLabelVariables{createLabelInput{Name: name}}
+
+	resp, err := s.omnivoreRequest(ctx, query, variables)
+	if err != nil {
+		return "", err
 	}
 
 	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(retrieveResult)
 	if err != nil {
-		return false
+		return "", err
 	}
 
-	if len(retrieveResult.Data.SetLabels.Labels) == len(updatedLabelList) {
-		fmt.Println(fmt.Sprintf("Added label '%s' to article", label))
-		return true
+	result := retrieveResult.Data.CreateLabel
+	if len(result.ErrorCodes) > 0 || result.Label.Id == "" {
+		return "", fmt.Errorf("could not create label '%s': %s", name, strings.Join(result.ErrorCodes, ", "))
 	}
 
-	return false
+	labels[name] = result.Label.Id
+	return result.Label.Id, nil
 }
 
-func (s OmnivoreService) getSearchResults() ([]omnivoreItem, error) {
+type BySaved []omnivoreItem
+
+func (a BySaved) Len() int           { return len(a) }
+func (a BySaved) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a BySaved) Less(i, j int) bool { return a[i].SavedAt.Before(a[j].SavedAt) }
+
+func (s OmnivoreService) getSearchResults(ctx context.Context) ([]omnivoreItem, error) {
 	config := s.Config
 
 	retrieveResult := &searchResultData{}
 
-	query := "query Search($after: String, $first: Int, $query: String) { search(first: $first, after: $after, query: $query) { ... on SearchSuccess { edges { node { id title author slug pageType publishedAt savedAt url labels { id name } } } } ... on SearchError { errorCodes } } }"
+	query := "query Search($after: String, $first: Int, $query: String) { search(first: $first, after: $after, query: $query) { ... on SearchSuccess { edges { node { id title author slug pageType publishedAt savedAt url labels { id name } description siteName language image wordsCount } } } ... on SearchError { errorCodes } } }"
 	variables := searchPayloadVariables{
 		"0",
 		10,
 		config.Query,
 	}
 
-	resp, err := s.omnivoreRequest(query, variables)
+	resp, err := s.omnivoreRequest(ctx, query, variables)
 	if err != nil {
 		return []omnivoreItem{}, err
 	}
@@ -277,13 +594,21 @@ func (s OmnivoreService) getSearchResults() ([]omnivoreItem, error) {
 			parsedSavedAt,
 			parsedURL,
 			item.Node.Labels,
+			item.Node.Description,
+			item.Node.SiteName,
+			item.Node.Language,
+			item.Node.Image,
+			item.Node.WordsCount,
 		})
 	}
 
+	// newest first, like pocket's items
+	sort.Stable(sort.Reverse(BySaved(items)))
+
 	return items, nil
 }
 
-func (s OmnivoreService) getArticleContent(articleId string) (omnivoreArticle, error) {
+func (s OmnivoreService) getArticleContent(ctx context.Context, articleId string) (omnivoreArticle, error) {
 	config := s.Config
 
 	retrieveResult := &articleResultData{}
@@ -294,7 +619,7 @@ func (s OmnivoreService) getArticleContent(articleId string) (omnivoreArticle, e
 		articleId,
 	}
 
-	resp, err := s.omnivoreRequest(query, variables)
+	resp, err := s.omnivoreRequest(ctx, query, variables)
 	if err != nil {
 		return omnivoreArticle{}, err
 	}
@@ -305,32 +630,21 @@ func (s OmnivoreService) getArticleContent(articleId string) (omnivoreArticle, e
 		return omnivoreArticle{}, err
 	}
 
-	// TODO: strip extra head and body tags added by Parse()
+	// only the body, the header and footer are added with the epub
 	parsedContent, _ := html.Parse(strings.NewReader(retrieveResult.Data.Article.Article.Content))
-	bodyTag := dom.QuerySelector(parsedContent, "body")
-
-	articleLink := dom.CreateElement("a")
-	dom.SetTextContent(articleLink, retrieveResult.Data.Article.Article.Url)
-	dom.SetAttribute(articleLink, "href", retrieveResult.Data.Article.Article.Url)
-	dom.PrependChild(bodyTag, articleLink)
-
-	articleTitle := dom.CreateElement("h1")
-	dom.SetTextContent(articleTitle, retrieveResult.Data.Article.Article.Title)
-	dom.PrependChild(bodyTag, articleTitle)
-
-	retrieveResult.Data.Article.Article.Content = dom.OuterHTML(parsedContent)
+	retrieveResult.Data.Article.Article.Content = dom.InnerHTML(dom.QuerySelector(parsedContent, "body"))
 
 	return retrieveResult.Data.Article.Article, nil
 }
 
-func (s OmnivoreService) getLabelList() (map[string]string, error) {
+func (s OmnivoreService) getLabelList(ctx context.Context) (map[string]string, error) {
 	fmt.Println("getting label list")
 	retrieveResult := &LabelResultData{}
 
 	query := "query GetLabels { labels { ... on LabelsSuccess { labels { ...LabelFields } } ... on LabelsError { errorCodes } } } fragment LabelFields on Label { id name }"
 	var variables interface{}
 
-	resp, err := s.omnivoreRequest(query, variables)
+	resp, err := s.omnivoreRequest(ctx, query, variables)
 	if err != nil {
 		return map[string]string{}, err
 	}
@@ -349,17 +663,20 @@ func (s OmnivoreService) getLabelList() (map[string]string, error) {
 	return labels, nil
 }
 
-func (s OmnivoreService) omnivoreRequest(query string, variables interface{}) (*http.Response, error) {
+func (s OmnivoreService) omnivoreRequest(ctx context.Context, query string, variables interface{}) (*http.Response, error) {
 	config := s.Config
 
 	body, _ := json.Marshal(omnivorePayload{query, variables})
 
-	req, _ := http.NewRequest("POST", "https://api-prod.omnivore.app/api/graphql", bytes.NewReader(body))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api-prod.omnivore.app/api/graphql", bytes.NewReader(body))
 	req.Header.Add("X-Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", config.ApiKey)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doRequest(httpClient, req)
+	if err != nil {
+		return nil, err
+	}
 
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("got response %d; X-Error=[%s]", resp.StatusCode, resp.Header.Get("X-Error"))
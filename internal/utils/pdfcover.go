@@ -0,0 +1,373 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A cover page is put in front of a PDF with an incremental update: the
+// file is left as it is and new objects are appended, a page tree with the
+// cover and the old page tree, and a catalog pointing to it. Only PDFs with a
+// classic cross-reference table whose catalog and page tree are plain
+// objects can be updated that way; the others are delivered without cover.
+
+var errPDFNotSupported = errors.New("pdf structure not supported")
+
+// addPDFCover puts a generated cover page in front of the PDF at path
+func addPDFCover(ctx context.Context, path string, title string, meta articleMetadata) {
+	cover, err := renderCover(newCoverInfo(ctx, title, meta, meta.WordCount))
+	if err != nil {
+		fmt.Println("Could not generate cover:", err)
+		return
+	}
+
+	err = prependPDFPage(path, cover)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Could not add cover to '%s': %s", title, err))
+	}
+}
+
+type pdfRef struct {
+	num, gen int
+}
+
+func (r pdfRef) String() string {
+	return fmt.Sprintf("%d %d R", r.num, r.gen)
+}
+
+var (
+	pdfStartXref = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	pdfSubsec    = regexp.MustCompile(`^(\d+)\s+(\d+)$`)
+	pdfEntry     = regexp.MustCompile(`^(\d{10})\s+(\d{5})\s+([nf])`)
+	pdfFirstKid  = regexp.MustCompile(`/Kids\s*\[\s*(\d+)\s+(\d+)\s+R`)
+	pdfMediaBox  = regexp.MustCompile(`/MediaBox\s*\[\s*([-\d.]+)\s+([-\d.]+)\s+([-\d.]+)\s+([-\d.]+)\s*\]`)
+	pdfRefEntry  = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+(\d+)\s+R`)
+	pdfIntEntry  = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)`)
+	pdfPagesRef  = regexp.MustCompile(`/Pages\s+\d+\s+\d+\s+R`)
+	pdfID        = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+)
+
+// pdfDictEntry returns the submatches of the first entry for key matched by
+// entry, whose first group is the key
+func pdfDictEntry(dict string, key string, entry *regexp.Regexp) []string {
+	for _, m := range entry.FindAllStringSubmatch(dict, -1) {
+		if m[1] == key {
+			return m
+		}
+	}
+	return nil
+}
+
+func pdfDictRef(dict string, key string) (pdfRef, bool) {
+	m := pdfDictEntry(dict, key, pdfRefEntry)
+	if m == nil {
+		return pdfRef{}, false
+	}
+	num, _ := strconv.Atoi(m[2])
+	gen, _ := strconv.Atoi(m[3])
+	return pdfRef{num, gen}, true
+}
+
+func pdfDictInt(dict string, key string) (int, bool) {
+	m := pdfDictEntry(dict, key, pdfIntEntry)
+	if m == nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(m[2])
+	return i, err == nil
+}
+
+// pdfXref is the newest offset of each object, following /Prev
+type pdfXref struct {
+	offsets   map[int]int64
+	trailer   string // the newest trailer dictionary
+	startxref int64
+}
+
+func readPDFXref(f *os.File, size int64) (*pdfXref, error) {
+	tailSize := int64(1024)
+	if size < tailSize {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	_, err := f.ReadAt(tail, size-tailSize)
+	if err != nil {
+		return nil, err
+	}
+	m := pdfStartXref.FindSubmatch(tail)
+	if m == nil {
+		return nil, fmt.Errorf("%w: no startxref", errPDFNotSupported)
+	}
+	startxref, _ := strconv.ParseInt(string(m[1]), 10, 64)
+
+	xref := &pdfXref{offsets: map[int]int64{}, startxref: startxref}
+	offset := startxref
+	for sections := 0; ; sections++ {
+		if offset <= 0 || offset >= size || sections > 100 {
+			return nil, fmt.Errorf("%w: broken cross-reference table", errPDFNotSupported)
+		}
+
+		trailer, err := readPDFXrefSection(f, size, offset, xref.offsets)
+		if err != nil {
+			return nil, err
+		}
+		if xref.trailer == "" {
+			xref.trailer = trailer
+		}
+
+		prev, ok := pdfDictInt(trailer, "Prev")
+		if !ok {
+			return xref, nil
+		}
+		offset = int64(prev)
+	}
+}
+
+// readPDFXrefSection adds the entries of one section that are not known from
+// a newer one, and returns its trailer dictionary
+func readPDFXrefSection(f *os.File, size int64, offset int64, offsets map[int]int64) (string, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	line, _ := r.ReadString('\n')
+	if strings.TrimSpace(line) != "xref" {
+		// a cross-reference stream, PDF 1.5 and later
+		return "", fmt.Errorf("%w: compressed cross-reference", errPDFNotSupported)
+	}
+
+	first, count := 0, 0
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "trailer") {
+			rest, _ := io.ReadAll(io.LimitReader(r, 4096))
+			dict, ok := pdfDict(line + "\n" + string(rest))
+			if !ok {
+				return "", fmt.Errorf("%w: no trailer", errPDFNotSupported)
+			}
+			return dict, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: broken cross-reference table", errPDFNotSupported)
+		}
+
+		if m := pdfSubsec.FindStringSubmatch(line); m != nil {
+			first, _ = strconv.Atoi(m[1])
+			count, _ = strconv.Atoi(m[2])
+			continue
+		}
+		if m := pdfEntry.FindStringSubmatch(line); m != nil && count > 0 {
+			if _, known := offsets[first]; !known {
+				entryOffset, _ := strconv.ParseInt(m[1], 10, 64)
+				if m[3] == "f" {
+					entryOffset = 0
+				}
+				offsets[first] = entryOffset
+			}
+			first++
+			count--
+		}
+	}
+}
+
+// pdfDict returns the first dictionary in s, nested dictionaries included
+func pdfDict(s string) (string, bool) {
+	start := strings.Index(s, "<<")
+	if start < 0 {
+		return "", false
+	}
+
+	depth := 0
+	inString := 0
+	for i := start; i < len(s)-1; i++ {
+		switch {
+		case inString > 0 && s[i] == '\\':
+			i++
+		case s[i] == '(':
+			inString++
+		case inString > 0 && s[i] == ')':
+			inString--
+		case inString > 0:
+		case s[i] == '<' && s[i+1] == '<':
+			depth++
+			i++
+		case s[i] == '>' && s[i+1] == '>':
+			depth--
+			i++
+			if depth == 0 {
+				return s[start : i+1], true
+			}
+		}
+	}
+	return "", false
+}
+
+func readPDFObject(f *os.File, xref *pdfXref, ref pdfRef) (string, error) {
+	offset := xref.offsets[ref.num]
+	if offset == 0 {
+		// free, or inside an object stream
+		return "", fmt.Errorf("%w: object %d not found", errPDFNotSupported, ref.num)
+	}
+
+	buf := make([]byte, 64<<10)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	object := string(buf[:n])
+
+	header := fmt.Sprintf("%d %d obj", ref.num, ref.gen)
+	if !strings.HasPrefix(strings.TrimSpace(object), header) {
+		return "", fmt.Errorf("%w: object %d not at its offset", errPDFNotSupported, ref.num)
+	}
+	dict, ok := pdfDict(object)
+	if !ok {
+		return "", fmt.Errorf("%w: object %d is no dictionary", errPDFNotSupported, ref.num)
+	}
+	return dict, nil
+}
+
+// prependPDFPage appends an incremental update to the PDF at path which adds
+// a page showing the JPEG in front of the others
+func prependPDFPage(path string, cover []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	xref, err := readPDFXref(f, size)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(xref.trailer, "/Encrypt") {
+		return fmt.Errorf("%w: encrypted", errPDFNotSupported)
+	}
+	objectCount, ok := pdfDictInt(xref.trailer, "Size")
+	rootRef, rootOK := pdfDictRef(xref.trailer, "Root")
+	if !ok || !rootOK {
+		return fmt.Errorf("%w: incomplete trailer", errPDFNotSupported)
+	}
+
+	catalog, err := readPDFObject(f, xref, rootRef)
+	if err != nil {
+		return err
+	}
+	pagesRef, ok := pdfDictRef(catalog, "Pages")
+	if !ok {
+		return fmt.Errorf("%w: no page tree", errPDFNotSupported)
+	}
+	pages, err := readPDFObject(f, xref, pagesRef)
+	if err != nil {
+		return err
+	}
+	pageCount, ok := pdfDictInt(pages, "Count")
+	if !ok || strings.Contains(pages, "/Parent") {
+		return fmt.Errorf("%w: unexpected page tree", errPDFNotSupported)
+	}
+
+	width, height := pdfPageSize(f, xref, pages)
+	img, err := jpeg.DecodeConfig(bytes.NewReader(cover))
+	if err != nil {
+		return err
+	}
+
+	// the cover is scaled to fit the first page's size and centered
+	scale := width / float64(img.Width)
+	if s := height / float64(img.Height); s < scale {
+		scale = s
+	}
+	drawWidth, drawHeight := float64(img.Width)*scale, float64(img.Height)*scale
+	content := fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Cover Do Q", drawWidth, drawHeight, (width-drawWidth)/2, (height-drawHeight)/2)
+
+	catalogRef := pdfRef{objectCount, 0}
+	treeRef := pdfRef{objectCount + 1, 0}
+	pageRef := pdfRef{objectCount + 2, 0}
+	imageRef := pdfRef{objectCount + 3, 0}
+	contentRef := pdfRef{objectCount + 4, 0}
+
+	type pdfObject struct {
+		ref  pdfRef
+		body []byte
+	}
+	objects := []pdfObject{
+		{pagesRef, []byte("<< /Parent " + treeRef.String() + strings.TrimPrefix(pages, "<<"))},
+		{catalogRef, []byte(pdfPagesRef.ReplaceAllString(catalog, "/Pages "+treeRef.String()))},
+		{treeRef, []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s %s] /Count %d >>", pageRef, pagesRef, pageCount+1))},
+		{pageRef, []byte(fmt.Sprintf("<< /Type /Page /Parent %s /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Cover %s >> >> /Contents %s >>", treeRef, width, height, imageRef, contentRef))},
+		{imageRef, append([]byte(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n", img.Width, img.Height, len(cover))), append(cover, []byte("\nendstream")...)...)},
+		{contentRef, []byte(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))},
+	}
+
+	var update bytes.Buffer
+	update.WriteString("\n")
+	offsets := map[int]int64{}
+	for _, object := range objects {
+		offsets[object.ref.num] = size + int64(update.Len())
+		update.WriteString(fmt.Sprintf("%d %d obj\n", object.ref.num, object.ref.gen))
+		update.Write(object.body)
+		update.WriteString("\nendobj\n")
+	}
+
+	xrefOffset := size + int64(update.Len())
+	update.WriteString("xref\n")
+	update.WriteString(fmt.Sprintf("%d 1\n%010d %05d n\r\n", pagesRef.num, offsets[pagesRef.num], pagesRef.gen))
+	update.WriteString(fmt.Sprintf("%d %d\n", objectCount, len(objects)-1))
+	for _, object := range objects[1:] {
+		update.WriteString(fmt.Sprintf("%010d %05d n\r\n", offsets[object.ref.num], 0))
+	}
+
+	trailer := fmt.Sprintf("/Size %d /Root %s /Prev %d", objectCount+len(objects)-1, catalogRef, xref.startxref)
+	if infoRef, ok := pdfDictRef(xref.trailer, "Info"); ok {
+		trailer += " /Info " + infoRef.String()
+	}
+	if id := pdfID.FindString(xref.trailer); id != "" {
+		trailer += " " + id
+	}
+	update.WriteString(fmt.Sprintf("trailer\n<< %s >>\nstartxref\n%d\n%%%%EOF\n", trailer, xrefOffset))
+
+	_, err = f.Write(update.Bytes())
+	if err != nil {
+		// cut the partial update off again, the PDF is fine without it
+		_ = f.Truncate(size)
+		return err
+	}
+	return f.Sync()
+}
+
+// pdfPageSize takes the media box of the page tree or of its first page,
+// A4 when there is none
+func pdfPageSize(f *os.File, xref *pdfXref, pages string) (float64, float64) {
+	box := pdfMediaBox.FindStringSubmatch(pages)
+	if box == nil {
+		if m := pdfFirstKid.FindStringSubmatch(pages); m != nil {
+			num, _ := strconv.Atoi(m[1])
+			gen, _ := strconv.Atoi(m[2])
+			if page, err := readPDFObject(f, xref, pdfRef{num, gen}); err == nil {
+				box = pdfMediaBox.FindStringSubmatch(page)
+			}
+		}
+	}
+	if box == nil {
+		return 595, 842
+	}
+
+	var values [4]float64
+	for i := range values {
+		values[i], _ = strconv.ParseFloat(box[i+1], 64)
+	}
+	return values[2] - values[0], values[3] - values[1]
+}
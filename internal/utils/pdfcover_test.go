@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// copyFixture copies a file from testdata to a temporary directory, as
+// prependPDFPage changes the file it is given
+func copyFixture(t *testing.T, name string) (string, []byte) {
+	t.Helper()
+	original, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	err = os.WriteFile(path, original, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, original
+}
+
+// openPDF reads the catalog and page tree of the PDF at path the way
+// prependPDFPage does, checking that every object is where the
+// cross-reference table says, and returns the page count
+func openPDF(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xref, err := readPDFXref(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, offset := range xref.offsets {
+		if offset == 0 {
+			continue
+		}
+		header := make([]byte, 32)
+		n, _ := f.ReadAt(header, offset)
+		if !bytes.HasPrefix(header[:n], []byte(fmt.Sprintf("%d ", num))) || !bytes.Contains(header[:n], []byte(" obj")) {
+			t.Fatalf("object %d is not at offset %d: %q", num, offset, header[:n])
+		}
+	}
+
+	rootRef, ok := pdfDictRef(xref.trailer, "Root")
+	if !ok {
+		t.Fatalf("trailer without root: %s", xref.trailer)
+	}
+	catalog, err := readPDFObject(f, xref, rootRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pagesRef, ok := pdfDictRef(catalog, "Pages")
+	if !ok {
+		t.Fatalf("catalog without pages: %s", catalog)
+	}
+	pages, err := readPDFObject(f, xref, pagesRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, ok := pdfDictInt(pages, "Count")
+	if !ok {
+		t.Fatalf("page tree without count: %s", pages)
+	}
+
+	// the first page must be reachable too
+	if m := pdfFirstKid.FindStringSubmatch(pages); m != nil {
+		num, _ := strconv.Atoi(m[1])
+		gen, _ := strconv.Atoi(m[2])
+		if _, err := readPDFObject(f, xref, pdfRef{num, gen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return count
+}
+
+func testCover(t *testing.T) []byte {
+	t.Helper()
+	cover, err := renderCover(coverInfo{title: "A cover", site: "example.com", readingMinutes: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cover
+}
+
+func TestPrependPDFPage(t *testing.T) {
+	cover := testCover(t)
+	for _, name := range []string{"classic-xref.pdf", "hybrid-xref.pdf"} {
+		t.Run(name, func(t *testing.T) {
+			path, original := copyFixture(t, name)
+			before := openPDF(t, path)
+
+			err := prependPDFPage(path, cover)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			updated, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(updated, original) {
+				t.Error("the original file was changed, not appended to")
+			}
+			if after := openPDF(t, path); after != before+1 {
+				t.Errorf("page count = %d, want %d", after, before+1)
+			}
+		})
+	}
+}
+
+func TestPrependPDFPageUnsupported(t *testing.T) {
+	cover := testCover(t)
+	for _, name := range []string{"xref-stream.pdf", "encrypted.pdf"} {
+		t.Run(name, func(t *testing.T) {
+			path, original := copyFixture(t, name)
+
+			err := prependPDFPage(path, cover)
+			if !errors.Is(err, errPDFNotSupported) {
+				t.Fatalf("err = %v, want %v", err, errPDFNotSupported)
+			}
+
+			unchanged, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unchanged, original) {
+				t.Error("the file was changed")
+			}
+		})
+	}
+}
+
+func TestPDFDictEntries(t *testing.T) {
+	dict := "<< /Type /Pages /Parent 3 0 R /Kids [4 0 R 5 0 R] /Count 2 /Size 12 >>"
+
+	if ref, ok := pdfDictRef(dict, "Parent"); !ok || ref != (pdfRef{3, 0}) {
+		t.Errorf("Parent = %v, %v", ref, ok)
+	}
+	if _, ok := pdfDictRef(dict, "Count"); ok {
+		t.Error("Count is no reference")
+	}
+	if count, ok := pdfDictInt(dict, "Count"); !ok || count != 2 {
+		t.Errorf("Count = %d, %v", count, ok)
+	}
+	if _, ok := pdfDictInt(dict, "Siz"); ok {
+		t.Error("Siz is not in the dictionary")
+	}
+}
+
+func TestRenderCoverEmptyImage(t *testing.T) {
+	_, err := renderCover(coverInfo{title: "A cover", image: image.NewGray(image.Rect(0, 0, 0, 0))})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,444 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// PDFConfig is the layout of articles delivered as PDF instead of epub, for
+// annotating: the text doesn't reflow, so notes stay where they were written
+type PDFConfig struct {
+	Margin float64  `yaml:"margin,omitempty"` // mm kept free on the right for notes, default 40
+	Tags   []string `yaml:"tags,omitempty"`   // tags/labels of articles always delivered as PDF
+}
+
+const (
+	screenDPI         = 226
+	defaultNoteMargin = 40.0 // mm
+
+	// all sizes are in points, on a page the size of the screen
+	pdfPageWidth  = screenWidth * 72.0 / screenDPI
+	pdfPageHeight = screenHeight * 72.0 / screenDPI
+	pdfMargin     = 20.0
+	pdfFontSize   = 10.0
+	pdfLineHeight = 1.4
+	pdfIndent     = 14.0
+)
+
+func (c PDFConfig) GetMargin() float64 {
+	if c.Margin == 0 {
+		return defaultNoteMargin
+	}
+	return c.Margin
+}
+
+// renderPDF lays the XHTML of an article out on pages the size of the
+// tablet's screen, with an empty column for notes on the right
+func renderPDF(title string, content string, meta articleMetadata, cfg PDFConfig) ([]byte, error) {
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{
+		UnitStr: "pt",
+		Size:    gofpdf.SizeType{Wd: pdfPageWidth, Ht: pdfPageHeight},
+	})
+	pdf.SetTitle(title, true)
+	pdf.SetAuthor(strings.Join(meta.Authors, ", "), true)
+	pdf.SetSubject(meta.Source, true)
+	pdf.SetCreator("pocket2rm", true)
+	pdf.SetCreationDate(time.Now())
+
+	for _, font := range []struct {
+		family, style string
+		ttf           []byte
+	}{
+		{"text", "", goregular.TTF},
+		{"text", "B", gobold.TTF},
+		{"text", "I", goitalic.TTF},
+		{"text", "BI", gobolditalic.TTF},
+		{"mono", "", gomono.TTF},
+		{"mono", "B", gomonobold.TTF},
+		{"mono", "I", gomonoitalic.TTF},
+		{"mono", "BI", gomonobolditalic.TTF},
+	} {
+		pdf.AddUTF8FontFromBytes(font.family, font.style, font.ttf)
+	}
+
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin+cfg.GetMargin()*72/25.4)
+	pdf.SetAutoPageBreak(true, pdfMargin+pdfFontSize)
+	pdf.SetCellMargin(0)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(pdfPageHeight - pdfMargin)
+		pdf.SetFont("text", "", pdfFontSize*0.8)
+		pdf.CellFormat(0, pdfFontSize, strconv.Itoa(pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	base, _ := url.Parse(meta.Source)
+	r := &pdfRenderer{pdf: pdf, base: base, size: pdfFontSize}
+	r.setFont()
+	r.render(doc)
+
+	var buf bytes.Buffer
+	err = pdf.Output(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pdfRenderer walks the article and writes it with gofpdf, which wraps the
+// text; blocks start on a new line, with a gap that is only added once
+type pdfRenderer struct {
+	pdf                     *gofpdf.Fpdf
+	base                    *url.URL
+	size                    float64
+	bold, italic, mono, pre int
+	link                    string
+	space                   bool // a space is due before the next word
+	gap                     float64
+	lists                   []int // next number of each open list, 0 for unordered ones
+	cells                   int   // cells written in the current table row
+}
+
+// skippedElements have nothing that can be shown on paper
+var skippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Iframe: true, atom.Object: true, atom.Embed: true, atom.Svg: true, atom.Math: true,
+	atom.Form: true, atom.Button: true, atom.Input: true, atom.Select: true, atom.Textarea: true,
+	atom.Video: true, atom.Audio: true, atom.Canvas: true,
+}
+
+var headingSizes = map[atom.Atom]float64{
+	atom.H1: 1.6, atom.H2: 1.35, atom.H3: 1.15, atom.H4: 1, atom.H5: 1, atom.H6: 1,
+}
+
+func (r *pdfRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		r.children(n)
+		return
+	}
+	if skippedElements[n.DataAtom] {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.block(r.size * 0.8)
+		size := r.size
+		r.size *= headingSizes[n.DataAtom]
+		r.bold++
+		r.children(n)
+		r.bold--
+		r.size = size
+		r.block(r.size * 0.4)
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Main, atom.Header, atom.Footer, atom.Aside,
+		atom.Figure, atom.Dl, atom.Dt, atom.Table, atom.Details, atom.Summary, atom.Address, atom.Nav:
+		r.block(r.size * 0.6)
+		r.children(n)
+		r.block(r.size * 0.6)
+	case atom.Blockquote, atom.Dd:
+		r.block(r.size * 0.6)
+		r.indent(pdfIndent)
+		if n.DataAtom == atom.Blockquote {
+			r.italic++
+		}
+		r.children(n)
+		if n.DataAtom == atom.Blockquote {
+			r.italic--
+		}
+		r.block(r.size * 0.6)
+		r.indent(-pdfIndent)
+	case atom.Pre:
+		r.block(r.size * 0.6)
+		r.pre++
+		r.mono++
+		r.children(n)
+		r.mono--
+		r.pre--
+		r.block(r.size * 0.6)
+	case atom.Ul, atom.Ol:
+		r.block(r.size * 0.4)
+		next := 0
+		if n.DataAtom == atom.Ol {
+			next = 1
+			if start, err := strconv.Atoi(nodeAttribute(n, "start")); err == nil {
+				next = start
+			}
+		}
+		r.lists = append(r.lists, next)
+		r.indent(pdfIndent)
+		r.children(n)
+		r.block(r.size * 0.4)
+		r.indent(-pdfIndent)
+		r.lists = r.lists[:len(r.lists)-1]
+	case atom.Li:
+		r.listItem()
+		r.children(n)
+		r.block(r.size * 0.2)
+	case atom.Tr:
+		r.block(0)
+		r.cells = 0
+		r.children(n)
+		r.block(0)
+	case atom.Td, atom.Th:
+		if r.cells > 0 {
+			r.write(" | ")
+		}
+		r.cells++
+		if n.DataAtom == atom.Th {
+			r.bold++
+		}
+		r.children(n)
+		if n.DataAtom == atom.Th {
+			r.bold--
+		}
+	case atom.Figcaption, atom.Caption:
+		r.block(r.size * 0.3)
+		size := r.size
+		r.size *= 0.85
+		r.italic++
+		r.children(n)
+		r.italic--
+		r.size = size
+		r.block(r.size * 0.6)
+	case atom.Hr:
+		r.block(r.size)
+		r.flushGap()
+		y := r.pdf.GetY()
+		left, _, right, _ := r.pdf.GetMargins()
+		r.pdf.Line(left, y, pdfPageWidth-right, y)
+		r.block(r.size)
+	case atom.Br:
+		r.pdf.Ln(r.lineHeight())
+		r.space = false
+	case atom.Img:
+		r.image(n)
+	case atom.B, atom.Strong:
+		r.bold++
+		r.children(n)
+		r.bold--
+	case atom.I, atom.Em, atom.Cite, atom.Var:
+		r.italic++
+		r.children(n)
+		r.italic--
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		r.mono++
+		r.children(n)
+		r.mono--
+	case atom.A:
+		link := r.link
+		r.link = linkTarget(nodeAttribute(n, "href"), r.base)
+		r.children(n)
+		r.link = link
+	default:
+		r.children(n)
+	}
+}
+
+func (r *pdfRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+func (r *pdfRenderer) lineHeight() float64 {
+	return r.size * pdfLineHeight
+}
+
+func (r *pdfRenderer) setFont() {
+	family, style := "text", ""
+	if r.mono > 0 {
+		family = "mono"
+	}
+	if r.bold > 0 {
+		style += "B"
+	}
+	if r.italic > 0 {
+		style += "I"
+	}
+	size := r.size
+	if r.mono > 0 && r.pre == 0 {
+		size *= 0.9
+	}
+	r.pdf.SetFont(family, style, size)
+}
+
+func (r *pdfRenderer) atLineStart() bool {
+	left, _, _, _ := r.pdf.GetMargins()
+	return r.pdf.GetX() <= left+0.01
+}
+
+// block ends the current line and asks for at least gap before what
+// follows
+func (r *pdfRenderer) block(gap float64) {
+	if !r.atLineStart() {
+		r.pdf.Ln(r.lineHeight())
+	}
+	r.space = false
+	r.gap = math.Max(r.gap, gap)
+}
+
+func (r *pdfRenderer) flushGap() {
+	if r.gap == 0 {
+		return
+	}
+	_, top, _, _ := r.pdf.GetMargins()
+	if r.pdf.GetY() > top+0.01 {
+		r.pdf.SetY(r.pdf.GetY() + r.gap)
+	}
+	r.gap = 0
+}
+
+func (r *pdfRenderer) indent(dx float64) {
+	left, _, _, _ := r.pdf.GetMargins()
+	r.pdf.SetLeftMargin(left + dx)
+	r.pdf.SetX(left + dx)
+}
+
+// listItem puts the bullet or number into the indentation of the list
+func (r *pdfRenderer) listItem() {
+	r.block(0)
+	r.flushGap()
+	marker := "•"
+	if depth := len(r.lists); depth > 0 && r.lists[depth-1] > 0 {
+		marker = fmt.Sprintf("%d.", r.lists[depth-1])
+		r.lists[depth-1]++
+	}
+	r.setFont()
+	left, _, _, _ := r.pdf.GetMargins()
+	r.pdf.SetX(left - r.pdf.GetStringWidth(marker+" "))
+	r.pdf.Write(r.lineHeight(), marker)
+	r.pdf.SetX(left)
+}
+
+func (r *pdfRenderer) text(s string) {
+	s = pdfText(s)
+	if r.pre > 0 {
+		r.write(strings.ReplaceAll(s, "\t", "    "))
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		r.space = r.space || s != ""
+		return
+	}
+	if strings.TrimLeft(s, " \t\n\r\f") != s {
+		r.space = true
+	}
+	text := strings.Join(words, " ")
+	if r.space && !r.atLineStart() {
+		text = " " + text
+	}
+	r.write(text)
+	r.space = strings.TrimRight(s, " \t\n\r\f") != s
+}
+
+func (r *pdfRenderer) write(s string) {
+	r.flushGap()
+	r.setFont()
+	if r.link != "" {
+		r.pdf.WriteLinkString(r.lineHeight(), s, r.link)
+		return
+	}
+	r.pdf.Write(r.lineHeight(), s)
+}
+
+// image draws an image that inlineImages turned into a data URL, as wide
+// as it is on the screen but at most as wide as the text
+func (r *pdfRenderer) image(n *html.Node) {
+	src := nodeAttribute(n, "src")
+	imageType, data := pdfImageData(src)
+	if data == nil {
+		if alt := nodeAttribute(n, "alt"); alt != "" {
+			r.italic++
+			r.text(alt)
+			r.italic--
+		}
+		return
+	}
+
+	name := fmt.Sprintf("%x", sha1.Sum(data))
+	options := gofpdf.ImageOptions{ImageType: imageType}
+	info := r.pdf.RegisterImageOptionsReader(name, options, bytes.NewReader(data))
+	if info == nil || r.pdf.Err() || info.Width() == 0 || info.Height() == 0 {
+		return
+	}
+
+	left, top, right, bottom := r.pdf.GetMargins()
+	maxWidth := pdfPageWidth - left - right
+	maxHeight := pdfPageHeight - top - bottom - r.lineHeight()
+	width := math.Min(maxWidth, info.Width()*72/screenDPI)
+	if strings.Contains(" "+nodeAttribute(n, "class")+" ", " qr ") {
+		width = maxWidth / 4
+	}
+	height := width * info.Height() / info.Width()
+	if height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+
+	r.block(r.size * 0.4)
+	r.flushGap()
+	if r.pdf.GetY()+height > pdfPageHeight-bottom {
+		r.pdf.AddPage()
+	}
+	y := r.pdf.GetY()
+	r.pdf.ImageOptions(name, left, y, width, height, false, options, 0, "")
+	r.pdf.SetY(y + height)
+	r.block(r.size * 0.4)
+}
+
+// pdfImageData decodes the PNG and JPEG data URLs made by prepareImage
+func pdfImageData(src string) (string, []byte) {
+	var imageType string
+	switch {
+	case strings.HasPrefix(src, "data:image/png;base64,"):
+		imageType = "PNG"
+	case strings.HasPrefix(src, "data:image/jpeg;base64,"):
+		imageType = "JPG"
+	default:
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(src[strings.Index(src, ",")+1:])
+	if err != nil {
+		return "", nil
+	}
+	return imageType, data
+}
+
+// pdfText drops what can't be shown: gofpdf only knows characters of the
+// Basic Multilingual Plane, e.g. no emoji, and soft hyphens would be printed
+func pdfText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0xFFFF || r == '\u00ad' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -2,10 +2,13 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -23,6 +26,34 @@ type PocketConfig struct {
 	ConsumerKey      string            `yaml:"consumerKey"`
 	AccessToken      string            `yaml:"accessToken"`
 	RequestParams    map[string]string `yaml:"requestParams"`
+	// what is done to an item after it was delivered
+	HandledTag string `yaml:"handledTag,omitempty"` // default "remarkable"
+	Archive    *bool  `yaml:"archive,omitempty"`    // default true
+	Favorite   bool   `yaml:"favorite,omitempty"`
+	TriggerTag string `yaml:"triggerTag,omitempty"` // removed once delivered, e.g. "to-tablet"
+	// failed conversions get this tag and are left in the queue
+	FailedTag string `yaml:"failedTag,omitempty"` // default "remarkable-failed"
+	// replaces the shared style for documents from pocket
+	Style  *StyleConfig `yaml:"style,omitempty"`
+	Format string       `yaml:"format,omitempty"` // replaces the shared format, "epub" or "pdf"
+}
+
+func (c PocketConfig) GetHandledTag() string {
+	if c.HandledTag == "" {
+		return "remarkable"
+	}
+	return c.HandledTag
+}
+
+func (c PocketConfig) GetArchive() bool {
+	return c.Archive == nil || *c.Archive
+}
+
+func (c PocketConfig) GetFailedTag() string {
+	if c.FailedTag == "" {
+		return "remarkable-failed"
+	}
+	return c.FailedTag
 }
 
 type Time time.Time
@@ -38,6 +69,22 @@ func (t *Time) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Count is a number pocket sends quoted, unquoted or as "" when it doesn't
+// know it; anything that is not a number is 0 rather than failing the
+// whole list
+type Count int
+
+func (c *Count) UnmarshalJSON(b []byte) error {
+	i, err := strconv.Atoi(string(bytes.Trim(b, `"`)))
+	if err != nil {
+		i = 0
+	}
+
+	*c = Count(i)
+
+	return nil
+}
+
 type ByAdded []pocketItem
 
 func (a ByAdded) Len() int           { return len(a) }
@@ -54,6 +101,13 @@ type Item struct {
 	IsArticle     int                  `json:"is_article,string"`
 	TimeAdded     Time                 `json:"time_added"`
 	Tags          map[string]PocketTag `json:"tags"`
+	// only returned with detailType=complete
+	Excerpt        string               `json:"excerpt"`
+	Lang           string               `json:"lang"`
+	TopImageURL    string               `json:"top_image_url"`
+	Authors        PocketAuthors        `json:"authors"`
+	DomainMetadata PocketDomainMetadata `json:"domain_metadata"`
+	WordCount      Count                `json:"word_count"`
 }
 
 func (item Item) Title() string {
@@ -64,12 +118,73 @@ func (item Item) Title() string {
 	return title
 }
 
+func (item Item) metadata() articleMetadata {
+	var authors []string
+	for _, author := range item.Authors.sorted() {
+		authors = append(authors, author.Name)
+	}
+	var tags []string
+	for tag := range item.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return articleMetadata{
+		Title:       item.Title(),
+		Authors:     authors,
+		Description: item.Excerpt,
+		Language:    item.Lang,
+		Source:      item.ResolvedURL,
+		Publisher:   item.DomainMetadata.Name,
+		Image:       item.TopImageURL,
+		Saved:       time.Time(item.TimeAdded),
+		WordCount:   int(item.WordCount),
+		Tags:        tags,
+	}
+}
+
+type PocketAuthor struct {
+	AuthorID string `json:"author_id"`
+	Name     string `json:"name"`
+}
+
+// PocketAuthors is sent as an empty list instead of an object when an item
+// has no authors
+type PocketAuthors map[string]PocketAuthor
+
+func (a *PocketAuthors) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		*a = nil
+		return nil
+	}
+	return json.Unmarshal(b, (*map[string]PocketAuthor)(a))
+}
+
+// sorted orders the authors by id, so they come out the same every sync
+func (a PocketAuthors) sorted() []PocketAuthor {
+	var authors []PocketAuthor
+	for _, author := range a {
+		authors = append(authors, author)
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		idI, _ := strconv.Atoi(authors[i].AuthorID)
+		idJ, _ := strconv.Atoi(authors[j].AuthorID)
+		return idI < idJ
+	})
+	return authors
+}
+
+type PocketDomainMetadata struct {
+	Name string `json:"name"`
+}
+
 type pocketItem struct {
 	id    string
 	url   *url.URL
 	added time.Time
 	title string
 	tags  map[string]PocketTag
+	meta  articleMetadata
 }
 
 type PocketModify struct {
@@ -81,13 +196,15 @@ type PocketModify struct {
 type PocketModifyActions struct {
 	Action string `json:"action"`
 	ItemID string `json:"item_id"`
-	Tags   string `json:"tags"`
+	Tags   string `json:"tags,omitempty"`
 }
 
+// PocketModifyResult has one entry per action, in the order they were sent;
+// a result is false for a failed action
 type PocketModifyResult struct {
-	Results []string
-	Errors  []string
-	Status  int
+	Results []json.RawMessage `json:"action_results"`
+	Errors  []json.RawMessage `json:"action_errors"`
+	Status  int               `json:"status"`
 }
 
 type PocketResult struct {
@@ -104,6 +221,24 @@ type PocketRetrieve struct {
 	ContentType string `json:"contentType"`
 	DetailType  string `json:"detailType"`
 	Sort        string `json:"sort"`
+	State       string `json:"state,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+}
+
+type PocketAdd struct {
+	ConsumerKey string `json:"consumer_key"`
+	AccessToken string `json:"access_token"`
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+}
+
+type PocketAddResult struct {
+	Item   PocketAddItem
+	Status int
+}
+
+type PocketAddItem struct {
+	ItemID string `json:"item_id"`
 }
 
 type PocketTag struct {
@@ -119,7 +254,7 @@ func (s PocketService) GetRemarkableConfig() *RemarkableConfig {
 	}
 }
 
-func (s PocketService) getPocketItems() ([]pocketItem, error) {
+func (s PocketService) getPocketItems(ctx context.Context) ([]pocketItem, error) {
 	// unfortunately cannot use github.com/motemen/go-pocket
 	// because of 32bit architecture
 	// Item.ItemID in github.com/motemen/go-pocket is int, which cannot store enough
@@ -129,20 +264,28 @@ func (s PocketService) getPocketItems() ([]pocketItem, error) {
 
 	retrieveResult := &PocketResult{}
 
+	// tags and authors are only sent with the complete details
+	detailType := config.RequestParams["detailType"]
+	if detailType == "" {
+		detailType = "complete"
+	}
+
 	body, _ := json.Marshal(PocketRetrieve{
 		config.ConsumerKey,
 		config.AccessToken,
 		config.RequestParams["count"],
 		config.RequestParams["contentType"],
-		config.RequestParams["detailType"],
+		detailType,
 		config.RequestParams["sort"],
+		config.RequestParams["state"],
+		config.RequestParams["tag"],
 	})
 
-	req, _ := http.NewRequest("POST", "https://getpocket.com/v3/get", bytes.NewReader(body))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://getpocket.com/v3/get", bytes.NewReader(body))
 	req.Header.Add("X-Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doRequest(httpClient, req)
 	if err != nil {
 		return []pocketItem{}, err
 	}
@@ -160,7 +303,7 @@ func (s PocketService) getPocketItems() ([]pocketItem, error) {
 	var items []pocketItem
 	for id, item := range retrieveResult.List {
 		parsedURL, _ := url.Parse(item.ResolvedURL)
-		items = append(items, pocketItem{id, parsedURL, time.Time(item.TimeAdded), item.Title(), item.Tags})
+		items = append(items, pocketItem{id, parsedURL, time.Time(item.TimeAdded), item.Title(), item.Tags, item.metadata()})
 	}
 
 	// sort by latest added article first
@@ -168,9 +311,13 @@ func (s PocketService) getPocketItems() ([]pocketItem, error) {
 	return items, nil
 }
 
+// alreadyHandled is true for delivered items as well as for failed ones,
+// which are only tried again once the failed tag is removed
 func (s PocketService) alreadyHandled(article pocketItem) bool {
+	config := s.Config
+
 	for _, tag := range article.tags {
-		if tag.Tag == "remarkable" {
+		if tag.Tag == config.GetHandledTag() || tag.Tag == config.GetFailedTag() {
 			return true
 		}
 	}
@@ -178,15 +325,44 @@ func (s PocketService) alreadyHandled(article pocketItem) bool {
 	return false
 }
 
-func (s PocketService) registerHandled(article pocketItem) {
+func (s PocketService) handledActions(article pocketItem) []PocketModifyActions {
 	config := s.Config
 
-	modifyResult := &PocketModifyResult{}
-
 	actions := []PocketModifyActions{
-		{"tags_add", article.id, "remarkable"},
-		{"archive", article.id, ""},
+		{"tags_add", article.id, config.GetHandledTag()},
+	}
+	if config.TriggerTag != "" {
+		actions = append(actions, PocketModifyActions{"tags_remove", article.id, config.TriggerTag})
+	}
+	if config.Favorite {
+		actions = append(actions, PocketModifyActions{"favorite", article.id, ""})
+	}
+	if config.GetArchive() {
+		actions = append(actions, PocketModifyActions{"archive", article.id, ""})
+	}
+	return actions
+}
+
+func (s PocketService) failedActions(article pocketItem) []PocketModifyActions {
+	return []PocketModifyActions{
+		{"tags_add", article.id, s.Config.GetFailedTag()},
+	}
+}
+
+func (s PocketService) registerHandled(ctx context.Context, article pocketItem) error {
+	failed, err := s.sendActions(ctx, s.handledActions(article))
+	if err == nil && len(failed) > 0 {
+		err = fmt.Errorf("pocket rejected %d of the actions", len(failed))
 	}
+	return err
+}
+
+// sendActions sends all actions with a single request and returns the
+// actions pocket did not apply
+func (s PocketService) sendActions(ctx context.Context, actions []PocketModifyActions) ([]PocketModifyActions, error) {
+	config := s.Config
+
+	modifyResult := &PocketModifyResult{}
 
 	body, _ := json.Marshal(PocketModify{
 		config.ConsumerKey,
@@ -194,66 +370,318 @@ func (s PocketService) registerHandled(article pocketItem) {
 		actions,
 	})
 
-	req, _ := http.NewRequest("POST", "https://getpocket.com/v3/send", bytes.NewReader(body))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://getpocket.com/v3/send", bytes.NewReader(body))
 	req.Header.Add("X-Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doRequest(httpClient, req)
 	if err != nil {
 		fmt.Println(err)
+		return actions, err
 	}
 
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err := fmt.Errorf("got response %d; X-Error=[%s]", resp.StatusCode, resp.Header.Get("X-Error"))
 		fmt.Println(err.Error())
+		return actions, err
 	}
 
-	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(modifyResult)
 	if err != nil {
 		fmt.Println(err)
+		return actions, err
 	}
+
+	var failed []PocketModifyActions
+	for i, action := range actions {
+		if i >= len(modifyResult.Results) || string(modifyResult.Results[i]) == "false" {
+			fmt.Println(fmt.Sprintf("pocket did not apply %s to %s", action.Action, action.ItemID))
+			failed = append(failed, action)
+		}
+	}
+
+	return failed, nil
+}
+
+func getPendingActionsPath() string {
+	userHomeDir := getUserHomeDir()
+
+	return filepath.Join(userHomeDir, ".pocket2rm-pending-actions.json")
 }
 
-func (s PocketService) GenerateFiles(maxArticles uint) error {
+// maxActionAttempts is how often pocket may reject an action before later
+// syncs give up on it, e.g. for an item that was deleted meanwhile
+const maxActionAttempts = 5
+
+// pendingAction is an action pocket has not applied yet
+type pendingAction struct {
+	PocketModifyActions
+	Attempts int `json:"attempts,omitempty"` // times pocket rejected it
+}
+
+// getPendingActions returns the actions earlier syncs could not send or
+// pocket rejected
+func getPendingActions() []pendingAction {
+	fileContent, err := os.ReadFile(getPendingActionsPath())
+	if err != nil {
+		return nil
+	}
+
+	var actions []pendingAction
+	_ = json.Unmarshal(fileContent, &actions)
+	return actions
+}
+
+func writePendingActions(actions []pendingAction) {
+	if len(actions) == 0 {
+		_ = os.Remove(getPendingActionsPath())
+		return
+	}
+
+	content, _ := json.Marshal(actions)
+	_ = os.WriteFile(getPendingActionsPath(), content, 0644)
+}
+
+// pocketActions collects the actions of a sync, together with those left
+// from earlier ones, and sends them with a single request at the end. Until
+// then they are kept in the pending actions file, so the actions of a sync
+// that was killed are sent by the next one instead of its items being
+// delivered again.
+type pocketActions struct {
+	s       PocketService
+	dryRun  bool
+	summary *SyncSummary
+	actions []pendingAction
+}
+
+func (a *pocketActions) add(actions ...PocketModifyActions) {
+	for _, action := range actions {
+		a.actions = append(a.actions, pendingAction{PocketModifyActions: action})
+	}
+	a.save()
+}
+
+func (a *pocketActions) save() {
+	if !a.dryRun {
+		writePendingActions(a.actions)
+	}
+}
+
+// flush sends the actions; the ones pocket couldn't be reached for or
+// rejected stay pending for the next sync
+func (a *pocketActions) flush() {
+	if len(a.actions) == 0 {
+		return
+	}
+	if a.dryRun {
+		fmt.Println(fmt.Sprintf("dry-run: would send %d actions to pocket", len(a.actions)))
+		return
+	}
+
+	actions := make([]PocketModifyActions, len(a.actions))
+	for i, action := range a.actions {
+		actions[i] = action.PocketModifyActions
+	}
+	fmt.Println(fmt.Sprintf("Sending %d actions to pocket", len(actions)))
+	// sent even when the sync was interrupted, so delivered items are not
+	// delivered a second time
+	failed, err := a.s.sendActions(context.Background(), actions)
+	if err != nil {
+		a.summary.noteError(err)
+		a.summary.addWarning(fmt.Sprintf("could not send %d actions to pocket, retrying them next sync: %s", len(failed), err))
+	}
+
+	// failed keeps the order of actions
+	var retry []pendingAction
+	rejected, dropped := 0, 0
+	for _, action := range a.actions {
+		if len(failed) == 0 || failed[0] != action.PocketModifyActions {
+			continue
+		}
+		failed = failed[1:]
+		if err == nil {
+			action.Attempts++
+			rejected++
+		}
+		if action.Attempts >= maxActionAttempts {
+			dropped++
+			continue
+		}
+		retry = append(retry, action)
+	}
+	if rejected > dropped {
+		a.summary.addWarning(fmt.Sprintf("pocket rejected %d actions, retrying them next sync", rejected-dropped))
+	}
+	if dropped > 0 {
+		a.summary.addWarning(fmt.Sprintf("pocket rejected %d actions %d times, they are not retried anymore", dropped, maxActionAttempts))
+	}
+
+	a.actions = retry
+	a.save()
+}
+
+func (s PocketService) Queue(ctx context.Context, maxArticles uint) ([]QueueItem, error) {
+	pocketArticles, err := s.getPocketItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var queue []QueueItem
+	for _, pocketItem := range pocketArticles {
+		if uint(len(queue)) == maxArticles {
+			break
+		}
+		if s.alreadyHandled(pocketItem) {
+			continue
+		}
+		queue = append(queue, QueueItem{pocketItem.title, pocketItem.url.String(), pocketItem.added})
+	}
+
+	return queue, nil
+}
+
+// SaveURL adds the URL to pocket and marks it handled right away, so the
+// next sync does not deliver it a second time
+func (s PocketService) SaveURL(ctx context.Context, u *url.URL, title string) error {
+	config := s.Config
+
+	addResult := &PocketAddResult{}
+
+	body, _ := json.Marshal(PocketAdd{
+		config.ConsumerKey,
+		config.AccessToken,
+		u.String(),
+		title,
+	})
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://getpocket.com/v3/add", bytes.NewReader(body))
+	req.Header.Add("X-Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := doRequest(httpClient, req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got response %d; X-Error=[%s]", resp.StatusCode, resp.Header.Get("X-Error"))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(addResult)
+	if err != nil {
+		return err
+	}
+
+	return s.registerHandled(ctx, pocketItem{id: addResult.Item.ItemID, url: u, added: time.Now(), title: title})
+}
+
+func (s PocketService) GenerateFiles(ctx context.Context, opts SyncOptions) (*SyncSummary, error) {
+	defer lockShared()()
+	// the config is read once for the whole sync
+	appConfig := GetAppConfig()
+
 	fmt.Println("inside generateFiles (pocket)")
-	rm := Remarkable{Config: s.GetRemarkableConfig()}
-	pocketArticles, err := s.getPocketItems()
+	summary := newSyncSummary(s.Name, opts)
+	rm := newDocumentWriter(appConfig.GetStorageLimits(), s.GetRemarkableConfig(), opts)
+
+	// actions left from earlier syncs are sent with this sync's, and their
+	// items are not delivered a second time in the meantime
+	actions := &pocketActions{s: s, dryRun: opts.DryRun, summary: summary, actions: getPendingActions()}
+	pending := map[string]bool{}
+	for _, action := range actions.actions {
+		pending[action.ItemID] = true
+	}
+
+	pocketArticles, err := s.getPocketItems(ctx)
 	if err != nil {
 		fmt.Println("Could not get pocket articles: ", err)
-		return err
+		summary.noteError(err)
+		return summary, err
 	}
 
-	var processed uint = 0
+	var candidates []pocketItem
 	for _, pocketItem := range pocketArticles {
+		if pending[pocketItem.id] {
+			summary.addSkipped(pocketItem.title, pocketItem.url.String(), "waiting for pocket to accept the changes of an earlier sync")
+			continue
+		}
 		if s.alreadyHandled(pocketItem) {
 			fmt.Println("already handled")
+			summary.addSkipped(pocketItem.title, pocketItem.url.String(), "already handled")
 			continue
 		}
+		candidates = append(candidates, pocketItem)
+	}
+
+	// articles that went into the digest are marked handled once it is written
+	var d *digest
+	var inDigest []pocketItem
+	if opts.Digest {
+		d = newDigest()
+	}
+
+	var processed uint = 0
+	convert := func(i int) (document, error) {
+		return convertURL(ctx, appConfig, candidates[i].url, candidates[i].meta)
+	}
+	convertInOrder(ctx, len(candidates), opts.Concurrency, convert, func(i int, doc document, err error) bool {
+		pocketItem := candidates[i]
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Could not convert article: %s (%s)", err, pocketItem.url))
+			summary.addSkipped(pocketItem.title, pocketItem.url.String(), err.Error())
+			summary.noteError(err)
+			if errors.Is(err, ErrNotEnoughSpace) {
+				// left untouched in pocket, the next ones would not fit either
+				return false
+			}
+			// a rate limited site is tried again next sync
+			var rateLimitErr *RateLimitError
+			if !errors.As(err, &rateLimitErr) {
+				actions.add(s.failedActions(pocketItem)...)
+			}
+			return true
+		}
 
-		fileName := getFilename(pocketItem.added, pocketItem.title)
-		extension := filepath.Ext(pocketItem.url.String())
-		if extension == ".pdf" {
-			fileContent := createPDFFileContent(pocketItem.url.String())
-			rm.generatePDF(fileName, fileContent)
+		if d != nil && d.add(doc) {
+			inDigest = append(inDigest, pocketItem)
 		} else {
-			title, XMLcontent, err := getReadableArticle(pocketItem.url)
+			fileName := documentName(appConfig, pocketItem.title, doc)
+			_, err = rm.writeDocument(fileName, doc)
+			if errors.Is(err, ErrDocumentTooLarge) || errors.Is(err, ErrInvalidEpub) {
+				summary.addSkipped(pocketItem.title, pocketItem.url.String(), err.Error())
+				actions.add(s.failedActions(pocketItem)...)
+				return true
+			}
 			if err != nil {
-				fmt.Println(fmt.Sprintf("Could not get readable article: %s (%s)", err, pocketItem.url))
-				s.registerHandled(pocketItem)
-				continue
+				// left untouched in pocket, so it is tried again next sync
+				summary.addSkipped(pocketItem.title, pocketItem.url.String(), fmt.Sprintf("could not write document: %s", err))
+				return false
 			}
-			fileContent := createEpubFileContent(title, XMLcontent, "pocket2rm")
-			rm.generateEpub(fileName, fileContent)
+			summary.addDocument(pocketItem.title, pocketItem.url.String(), fileName, doc.fileType)
+			actions.add(s.handledActions(pocketItem)...)
 		}
 
-		s.registerHandled(pocketItem)
 		processed++
-		fmt.Println(fmt.Sprintf("progress: %d/%d", processed, maxArticles))
-		if processed == maxArticles {
-			break
+		fmt.Println(fmt.Sprintf("progress: %d/%d", processed, opts.MaxArticles))
+		return opts.MaxArticles == 0 || processed < opts.MaxArticles
+	})
+
+	if len(inDigest) > 0 {
+		visibleName, err := d.write(ctx, appConfig, rm)
+		for _, pocketItem := range inDigest {
+			if err != nil {
+				summary.addSkipped(pocketItem.title, pocketItem.url.String(), fmt.Sprintf("could not write digest: %s", err))
+				continue
+			}
+			summary.addDocument(pocketItem.title, pocketItem.url.String(), visibleName, "epub")
+			actions.add(s.handledActions(pocketItem)...)
 		}
 	}
 
-	return nil
+	summary.finish(ctx)
+	actions.flush()
+
+	return summary, nil
 }
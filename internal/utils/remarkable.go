@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	pdf "github.com/balacode/one-file-pdf"
@@ -13,6 +15,7 @@ import (
 
 type Remarkable struct {
 	Config *RemarkableConfig
+	Limits StorageLimits
 }
 
 type RemarkableConfig struct {
@@ -22,21 +25,42 @@ type RemarkableConfig struct {
 }
 
 type DocumentContent struct {
-	ExtraMetadata  ExtraMetaData `json:"extraMetadata"`
-	FileType       string        `json:"fileType"`
-	FontName       string        `json:"fontName"`
-	LastOpenedPage int           `json:"lastOpenedPage"`
-	LineHeight     int           `json:"lineHeight"`
-	Margins        int           `json:"margins"`
-	Orientation    string        `json:"orientation"`
-	PageCount      int           `json:"pageCount"`
-	TextScale      int           `json:"textScale"`
-	Transform      Transform     `json:"transform"`
+	DocumentMetadata DocumentMetadata `json:"documentMetadata"`
+	ExtraMetadata    ExtraMetaData    `json:"extraMetadata"`
+	FileType         string           `json:"fileType"`
+	FontName         string           `json:"fontName"`
+	LastOpenedPage   int              `json:"lastOpenedPage"`
+	LineHeight       int              `json:"lineHeight"`
+	Margins          int              `json:"margins"`
+	Orientation      string           `json:"orientation"`
+	PageCount        int              `json:"pageCount"`
+	TextScale        int              `json:"textScale"`
+	Transform        Transform        `json:"transform"`
 }
 
 type ExtraMetaData struct {
 }
 
+// DocumentMetadata is what the library view shows and searches besides the
+// document name
+type DocumentMetadata struct {
+	Title           string   `json:"title,omitempty"`
+	Authors         []string `json:"authors,omitempty"`
+	PublicationDate string   `json:"publicationDate,omitempty"`
+	Publisher       string   `json:"publisher,omitempty"`
+	Description     string   `json:"description,omitempty"`
+	Language        string   `json:"language,omitempty"`
+	Source          string   `json:"source,omitempty"`
+}
+
+func newDocumentMetadata(title string, meta articleMetadata) DocumentMetadata {
+	var published string
+	if !meta.Published.IsZero() {
+		published = meta.Published.UTC().Format("2006-01-02")
+	}
+	return DocumentMetadata{title, meta.Authors, published, meta.Publisher, meta.Description, meta.Language, meta.Source}
+}
+
 type MetaData struct {
 	Deleted          bool   `json:"deleted"`
 	LastModified     string `json:"lastModified"`
@@ -84,51 +108,177 @@ func (r Remarkable) folderIsPresent(uuid string) bool {
 }
 
 // uuid is returned
-func (r Remarkable) generateEpub(visibleName string, fileContent []byte) string {
+func (r Remarkable) writeDocument(visibleName string, doc document) (string, error) {
+	defer doc.remove()
 
-	var lastModified = fmt.Sprintf("%d", time.Now().Unix())
+	err := checkStorage(r.articeFolderPath(), doc, r.Limits)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Not writing '%s': %s", visibleName, err))
+		return "", err
+	}
+	err = checkDocument(doc)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Not writing '%s': %s", visibleName, err))
+		return "", err
+	}
+
+	// sorting by date follows the order things were saved upstream
+	modified := doc.meta.Saved
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	return r.generateDocument(visibleName, doc.fileType, newDocumentMetadata(doc.title, doc.meta), documentFile{"." + doc.fileType, doc.content, doc.path}, modified)
+}
+
+func (r Remarkable) generatePDF(visibleName string, fileContent []byte) (string, error) {
+	return r.generateDocument(visibleName, "pdf", DocumentMetadata{}, documentFile{".pdf", fileContent, ""}, time.Now())
+}
+
+func (r Remarkable) generateDocument(visibleName string, fileType string, docMetadata DocumentMetadata, file documentFile, modified time.Time) (string, error) {
+
+	var lastModified = fmt.Sprintf("%d", modified.Unix())
 
 	config := r.Config
 	fileUUID := uuid.New().String()
 
-	fileName := filepath.Join(r.articeFolderPath(), fileUUID+".epub")
-	writeFile(fileName, fileContent)
+	err := r.writeDocumentFiles(fileUUID, []documentFile{
+		file,
+		{".content", r.getDotContentContent(fileType, docMetadata), ""},
+		{".metadata", r.getMetadataContent(visibleName, config.TargetFolderUUID, "DocumentType", lastModified), ""},
+	})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Could not write '%s': %s", visibleName, err))
+		return "", err
+	}
 
-	fileContent = r.getDotContentContent("epub")
-	fileName = filepath.Join(r.articeFolderPath(), fileUUID+".content")
-	writeFile(fileName, fileContent)
+	return fileUUID, nil
+}
 
-	fileContent = r.getMetadataContent(visibleName, config.TargetFolderUUID, "DocumentType", lastModified)
-	fileName = filepath.Join(r.articeFolderPath(), fileUUID+".metadata")
-	writeFile(fileName, fileContent)
+type documentFile struct {
+	extension string
+	content   []byte
+	path      string // a file on the same partition, moved instead of writing content
+}
+
+func (r Remarkable) stagingPath() string {
+	userHomeDir := getUserHomeDir()
 
-	return fileUUID
+	// same partition as the xochitl folder, so files can be renamed into place
+	return filepath.Join(userHomeDir, ".pocket2rm-staging")
 }
 
-func (r Remarkable) generatePDF(visibleName string, fileContent []byte) string {
+// writeDocumentFiles writes the files of a document into a staging folder,
+// fsyncs them and renames them into the xochitl folder in the given order.
+// The .metadata file, which makes the document show up, must come last.
+// Whatever was written is removed again when something fails; if the
+// process dies instead, the journal entry left behind tells
+// RecoverInterruptedWrites what to clean up.
+func (r Remarkable) writeDocumentFiles(fileUUID string, files []documentFile) error {
+	journalEntry := filepath.Join(journalPath(), fileUUID)
+	err := os.MkdirAll(journalPath(), 0755)
+	if err == nil {
+		err = writeFile(journalEntry, nil)
+	}
+	if err == nil {
+		err = syncDir(journalPath())
+	}
+	if err != nil {
+		return fmt.Errorf("could not write journal: %w", err)
+	}
 
-	var lastModified = fmt.Sprintf("%d", time.Now().Unix())
+	stagingDir := filepath.Join(r.stagingPath(), fileUUID)
+	err = os.MkdirAll(stagingDir, 0755)
+	if err == nil {
+		err = r.moveDocumentFiles(fileUUID, stagingDir, files)
+	}
+	if err != nil {
+		r.removeDocumentFiles(fileUUID)
+	}
+	_ = os.RemoveAll(stagingDir)
+	_ = os.Remove(journalEntry)
+	return err
+}
 
-	config := r.Config
-	fileUUID := uuid.New().String()
+// journalPath holds an empty file named after each document that is being
+// written, so recovery only ever touches documents pocket2rm wrote
+func journalPath() string {
+	userHomeDir := getUserHomeDir()
 
-	fileName := filepath.Join(r.articeFolderPath(), fileUUID+".pdf")
-	writeFile(fileName, fileContent)
+	return filepath.Join(userHomeDir, ".pocket2rm-journal")
+}
 
-	fileContent = r.getDotContentContent("pdf")
-	fileName = filepath.Join(r.articeFolderPath(), fileUUID+".content")
-	writeFile(fileName, fileContent)
+func (r Remarkable) moveDocumentFiles(fileUUID string, stagingDir string, files []documentFile) error {
+	for _, file := range files {
+		stagedName := filepath.Join(stagingDir, fileUUID+file.extension)
+		var err error
+		if file.path != "" {
+			err = moveFile(file.path, stagedName)
+		} else {
+			err = writeFile(stagedName, file.content)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := syncDir(stagingDir)
+	if err != nil {
+		return err
+	}
 
-	fileContent = r.getMetadataContent(visibleName, config.TargetFolderUUID, "DocumentType", lastModified)
-	fileName = filepath.Join(r.articeFolderPath(), fileUUID+".metadata")
-	writeFile(fileName, fileContent)
+	for _, file := range files {
+		err = os.Rename(filepath.Join(stagingDir, fileUUID+file.extension), filepath.Join(r.articeFolderPath(), fileUUID+file.extension))
+		if err != nil {
+			return err
+		}
+		err = syncDir(r.articeFolderPath())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	return fileUUID
+func (r Remarkable) removeDocumentFiles(fileUUID string) {
+	// metadata first, so a partly removed document is never visible
+	for _, extension := range []string{".metadata", ".content", ".epub", ".pdf"} {
+		_ = os.Remove(filepath.Join(r.articeFolderPath(), fileUUID+extension))
+	}
+}
+
+// RecoverInterruptedWrites removes documents whose writing was interrupted
+// by a crash or power loss, as listed in the journal, and leftover
+// downloads. It does nothing while another sync or a push is running.
+func (r Remarkable) RecoverInterruptedWrites() {
+	unlock, ok := tryLockExclusive()
+	if !ok {
+		fmt.Println("another sync or push is running, not recovering interrupted writes")
+		return
+	}
+	defer unlock()
+
+	cleanDownloads()
+
+	entries, _ := os.ReadDir(journalPath())
+	for _, entry := range entries {
+		fileUUID := entry.Name()
+		if _, err := uuid.Parse(fileUUID); err != nil {
+			continue
+		}
+		fmt.Println("removing interrupted document", fileUUID)
+		r.removeDocumentFiles(fileUUID)
+		_ = os.RemoveAll(filepath.Join(r.stagingPath(), fileUUID))
+		_ = os.Remove(filepath.Join(journalPath(), fileUUID))
+	}
 }
 
 func (r Remarkable) GenerateTargetFolder() {
 	config := r.Config
-	targetFolderUUID := r.generateTopLevelFolder(config.Service)
+	targetFolderUUID, err := r.generateTopLevelFolder(config.Service)
+	if err != nil {
+		fmt.Println("Could not create target folder: ", err)
+		return
+	}
 	config.TargetFolderUUID = targetFolderUUID
 	writeRemarkableConfig(config)
 }
@@ -148,29 +298,29 @@ func (r Remarkable) GenerateReloadFile() {
 		DrawText("Sync")
 	fileContent := pdfFile.Bytes()
 
-	reloadFileUUID := r.generatePDF("remove to sync", fileContent)
+	reloadFileUUID, err := r.generatePDF("remove to sync", fileContent)
+	if err != nil {
+		return
+	}
 	config := r.Config
 	config.ReloadUUID = reloadFileUUID
 	writeRemarkableConfig(config)
 }
 
-func (r Remarkable) generateTopLevelFolder(folderName string) string {
+func (r Remarkable) generateTopLevelFolder(folderName string) (string, error) {
 	var lastModified = fmt.Sprintf("%d", time.Now().Unix())
 	fileUUID := uuid.New().String()
 
-	fileName := filepath.Join(r.articeFolderPath(), fileUUID+".content")
-	writeFile(fileName, []byte("{}"))
-
-	fileContent := r.getMetadataContent(folderName, "", "CollectionType", lastModified)
-	fileName = filepath.Join(r.articeFolderPath(), fileUUID+".metadata")
-	writeFile(fileName, fileContent)
-
-	return fileUUID
+	err := r.writeDocumentFiles(fileUUID, []documentFile{
+		{".content", []byte("{}"), ""},
+		{".metadata", r.getMetadataContent(folderName, "", "CollectionType", lastModified), ""},
+	})
+	return fileUUID, err
 }
 
-func (r Remarkable) getDotContentContent(fileType string) []byte {
+func (r Remarkable) getDotContentContent(fileType string, docMetadata DocumentMetadata) []byte {
 	transform := Transform{1, 0, 0, 0, 1, 0, 0, 0, 1}
-	docContent := DocumentContent{ExtraMetaData{}, fileType, "", 0, -1, 100, "portrait", 1, 1, transform}
+	docContent := DocumentContent{docMetadata, ExtraMetaData{}, fileType, "", 0, -1, 100, "portrait", 1, 1, transform}
 	content, _ := json.Marshal(docContent)
 	return content
 }
@@ -181,6 +331,31 @@ func (r Remarkable) getMetadataContent(visibleName string, parentUUID string, fi
 	return content
 }
 
+type Folder struct {
+	UUID string
+	Name string
+}
+
+// ListFolders returns all folders on the tablet that are not deleted
+func (r Remarkable) ListFolders() []Folder {
+	var folders []Folder
+	metadataPaths, _ := filepath.Glob(filepath.Join(r.articeFolderPath(), "*.metadata"))
+	for _, metadataPath := range metadataPaths {
+		fileContent, _ := os.ReadFile(metadataPath)
+		var metadata MetaData
+		if json.Unmarshal(fileContent, &metadata) != nil {
+			continue
+		}
+		if metadata.Type != "CollectionType" || metadata.Deleted || metadata.Parent == "trash" {
+			continue
+		}
+		folders = append(folders, Folder{strings.TrimSuffix(filepath.Base(metadataPath), ".metadata"), metadata.VisibleName})
+	}
+
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders
+}
+
 func (r Remarkable) TargetFolderExists() bool {
 	config := r.Config
 	folderUUID := config.TargetFolderUUID
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// droppedElements are removed with everything in them: scripts, embedded
+// pages, forms and media can't be shown, and svg and math would need their
+// namespaces
+var droppedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Iframe: true, atom.Frame: true, atom.Frameset: true, atom.Object: true, atom.Embed: true, atom.Applet: true,
+	atom.Form: true, atom.Input: true, atom.Button: true, atom.Select: true, atom.Option: true, atom.Textarea: true,
+	atom.Canvas: true, atom.Audio: true, atom.Video: true, atom.Source: true, atom.Track: true, atom.Param: true,
+	atom.Svg: true, atom.Math: true, atom.Map: true, atom.Area: true, atom.Dialog: true,
+	atom.Head: true, atom.Title: true, atom.Meta: true, atom.Link: true, atom.Base: true,
+}
+
+// allowedAttributes lists the elements kept in epubs with their attributes,
+// besides the ones every element can have; other elements are replaced by
+// their content
+var allowedAttributes = map[atom.Atom][]string{
+	atom.A: {"href"}, atom.Abbr: nil, atom.Address: nil, atom.Article: nil, atom.Aside: nil,
+	atom.B: nil, atom.Bdi: nil, atom.Bdo: nil, atom.Blockquote: {"cite"}, atom.Br: nil,
+	atom.Caption: nil, atom.Cite: nil, atom.Code: nil, atom.Col: {"span"}, atom.Colgroup: {"span"},
+	atom.Dd: nil, atom.Del: {"cite", "datetime"}, atom.Details: nil, atom.Dfn: nil, atom.Div: nil, atom.Dl: nil, atom.Dt: nil,
+	atom.Em: nil, atom.Figcaption: nil, atom.Figure: nil, atom.Footer: nil,
+	atom.H1: nil, atom.H2: nil, atom.H3: nil, atom.H4: nil, atom.H5: nil, atom.H6: nil, atom.Header: nil, atom.Hr: nil,
+	atom.I: nil, atom.Img: {"src", "srcset", "sizes", "alt", "width", "height"}, atom.Ins: {"cite", "datetime"},
+	atom.Kbd: nil, atom.Li: {"value"}, atom.Main: nil, atom.Mark: nil, atom.Nav: nil, atom.Ol: {"start", "reversed", "type"},
+	atom.P: nil, atom.Pre: nil, atom.Q: {"cite"}, atom.Rp: nil, atom.Rt: nil, atom.Ruby: nil,
+	atom.S: nil, atom.Samp: nil, atom.Section: nil, atom.Small: nil, atom.Span: nil, atom.Strong: nil,
+	atom.Sub: nil, atom.Summary: nil, atom.Sup: nil,
+	atom.Table: nil, atom.Tbody: nil, atom.Td: {"colspan", "rowspan"}, atom.Tfoot: nil, atom.Th: {"colspan", "rowspan", "scope"},
+	atom.Thead: nil, atom.Time: {"datetime"}, atom.Tr: nil, atom.U: nil, atom.Ul: nil, atom.Var: nil, atom.Wbr: nil,
+}
+
+var globalAttributes = []string{"id", "class", "title", "lang", "dir"}
+
+// sanitizeContent makes the XHTML of an article safe for the tablet: only
+// allowed elements and attributes are kept, ids are valid and unique and
+// links are absolute. The HTML parser already fixes the nesting.
+func sanitizeContent(content string, base *url.URL) string {
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		fmt.Println("Could not parse article content:", err)
+		return "<p>" + html.EscapeString(xmlText(content)) + "</p>"
+	}
+
+	s := sanitizer{base: base, ids: map[string]bool{}, firstIDs: map[string]string{}}
+	var clean []*html.Node
+	for _, n := range nodes {
+		clean = append(clean, s.node(n, nil)...)
+	}
+
+	// links within the article follow their target to its new id
+	for _, attr := range s.fragments {
+		if id, ok := s.firstIDs[strings.TrimPrefix(attr.Val, "#")]; ok {
+			attr.Val = "#" + id
+		}
+	}
+
+	var out strings.Builder
+	for _, n := range clean {
+		_ = html.Render(&out, n)
+	}
+	return out.String()
+}
+
+type sanitizer struct {
+	base      *url.URL
+	ids       map[string]bool
+	firstIDs  map[string]string // what the first element with an id got
+	fragments []*html.Attribute // hrefs to ids in the article
+}
+
+// node returns the sanitized copies of n: none for dropped elements, the
+// children for unwrapped ones; parent is the sanitized parent
+func (s *sanitizer) node(n *html.Node, parent *html.Node) []*html.Node {
+	switch n.Type {
+	case html.TextNode:
+		return []*html.Node{{Type: html.TextNode, Data: xmlText(n.Data)}}
+	case html.ElementNode:
+		return s.element(n, parent)
+	}
+	// comments and doctypes
+	return nil
+}
+
+func (s *sanitizer) element(n *html.Node, parent *html.Node) []*html.Node {
+	if n.Namespace != "" || droppedElements[n.DataAtom] {
+		return nil
+	}
+	allowed, ok := allowedAttributes[n.DataAtom]
+	if !ok {
+		return s.children(n, parent)
+	}
+
+	clean := &html.Node{Type: html.ElementNode, Data: n.Data, DataAtom: n.DataAtom}
+	inList := parent != nil && (parent.DataAtom == atom.Ul || parent.DataAtom == atom.Ol)
+	inDl := parent != nil && parent.DataAtom == atom.Dl
+	if (n.DataAtom == atom.Li && !inList) || ((n.DataAtom == atom.Dt || n.DataAtom == atom.Dd) && !inDl) {
+		// items outside of a list are paragraphs
+		clean.Data, clean.DataAtom, allowed = "p", atom.P, nil
+	}
+
+	seen := map[string]bool{}
+	for _, attr := range n.Attr {
+		// the first of duplicate attributes wins
+		if attr.Namespace != "" || seen[attr.Key] || !(contains(globalAttributes, attr.Key) || contains(allowed, attr.Key)) {
+			continue
+		}
+		seen[attr.Key] = true
+
+		value := xmlText(attr.Val)
+		switch attr.Key {
+		case "id":
+			value = s.uniqueID(value)
+		case "href":
+			value = s.href(value)
+		case "src":
+			value = s.src(value)
+		}
+		if value != "" {
+			clean.Attr = append(clean.Attr, html.Attribute{Key: attr.Key, Val: value})
+		}
+	}
+
+	if clean.DataAtom == atom.Img && nodeAttribute(clean, "src") == "" {
+		// an image that can't be loaded leaves its description
+		alt := strings.TrimSpace(nodeAttribute(clean, "alt"))
+		if alt == "" {
+			return nil
+		}
+		em := &html.Node{Type: html.ElementNode, Data: "em", DataAtom: atom.Em}
+		em.AppendChild(&html.Node{Type: html.TextNode, Data: alt})
+		return []*html.Node{em}
+	}
+
+	for i := range clean.Attr {
+		if clean.Attr[i].Key == "href" && strings.HasPrefix(clean.Attr[i].Val, "#") {
+			s.fragments = append(s.fragments, &clean.Attr[i])
+		}
+	}
+	for _, c := range s.children(n, clean) {
+		clean.AppendChild(c)
+	}
+	return []*html.Node{clean}
+}
+
+func (s *sanitizer) children(n *html.Node, parent *html.Node) []*html.Node {
+	var result []*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		result = append(result, s.node(c, parent)...)
+	}
+	return result
+}
+
+// uniqueID turns id into a valid XML id that wasn't used before; note- ids
+// are left to linkNotes
+func (s *sanitizer) uniqueID(original string) string {
+	id := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(original))
+	if id == "" {
+		return ""
+	}
+	if first := []rune(id)[0]; !unicode.IsLetter(first) && first != '_' {
+		id = "id-" + id
+	}
+	if strings.HasPrefix(id, "note-") {
+		id = "article-" + id
+	}
+
+	unique := id
+	for i := 2; s.ids[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", id, i)
+	}
+	s.ids[unique] = true
+	if _, ok := s.firstIDs[original]; !ok {
+		s.firstIDs[original] = unique
+	}
+	return unique
+}
+
+// href keeps links to pages, mail addresses and ids in the article
+func (s *sanitizer) href(href string) string {
+	href = strings.TrimSpace(href)
+	if strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "mailto:") {
+		return href
+	}
+	return linkTarget(href, s.base)
+}
+
+// src keeps images on the web, which inlineImages downloads, and the ones
+// already inlined
+func (s *sanitizer) src(src string) string {
+	if strings.HasPrefix(src, "data:") && !strings.HasPrefix(src, "data:image/") {
+		return ""
+	}
+	return imageSource(html.Token{Attr: []html.Attribute{{Key: "src", Val: src}}}, s.base)
+}
+
+// textBlocks start a new paragraph in textOnly
+var textBlocks = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Hr: true, atom.Li: true, atom.Dt: true, atom.Dd: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Tr: true, atom.Figcaption: true,
+	atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true,
+}
+
+// textOnly is the last resort for an article whose epub is broken: just its
+// text, a paragraph for each block
+func textOnly(content string) string {
+	var out, paragraph strings.Builder
+	flush := func() {
+		if text := strings.Join(strings.Fields(paragraph.String()), " "); text != "" {
+			out.WriteString("<p>" + html.EscapeString(text) + "</p>\n")
+		}
+		paragraph.Reset()
+	}
+
+	skipping := 0
+	z := html.NewTokenizer(strings.NewReader(content))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		token := z.Token()
+		switch {
+		case tt == html.TextToken && skipping == 0:
+			paragraph.WriteString(xmlText(token.Data))
+		case droppedElements[token.DataAtom] && tt == html.StartTagToken && !voidElements[token.DataAtom]:
+			skipping++
+		case droppedElements[token.DataAtom] && tt == html.EndTagToken && skipping > 0:
+			skipping--
+		case textBlocks[token.DataAtom]:
+			flush()
+		}
+	}
+	flush()
+	return out.String()
+}
+
+// xmlText removes the characters XML doesn't allow, e.g. control characters
+// copied from a PDF
+func xmlText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != 0xFFFE && r != 0xFFFF) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package utils
+
+import "testing"
+
+func TestSanitizeContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "dropped elements",
+			content: `<p>text<script>alert(1)</script><style>p {}</style></p><iframe src="/x"></iframe><form><input name="q"></form><svg><text>drawn</text></svg>`,
+			want:    `<p>text</p>`,
+		},
+		{
+			name:    "unknown elements leave their content",
+			content: `<custom-card><p>kept</p></custom-card><font color="red">red</font><center>centered</center>`,
+			want:    `<p>kept</p>redcentered`,
+		},
+		{
+			name:    "allowed attributes",
+			content: `<p onclick="x()" style="color: red" class="lead" title="t" lang="en">a</p><td colspan="2" bgcolor="red">cell</td><ol start="3" type="a" onload="x()"><li value="4">b</li></ol>`,
+			want:    `<p class="lead" title="t" lang="en">a</p>cell<ol start="3" type="a"><li value="4">b</li></ol>`,
+		},
+		{
+			name:    "first of duplicate attributes",
+			content: `<p class="one" class="two">a</p>`,
+			want:    `<p class="one">a</p>`,
+		},
+		{
+			name:    "links",
+			content: `<a href="/about">relative</a><a href="javascript:alert(1)">script</a><a href="mailto:a@example.com">mail</a><a href="#top">fragment</a>`,
+			want:    `<a href="https://example.com/about">relative</a><a>script</a><a href="mailto:a@example.com">mail</a><a href="#top">fragment</a>`,
+		},
+		{
+			name:    "images",
+			content: `<img src="pic.png" alt="Pic" loading="lazy" onerror="x()"><img src="javascript:x()" alt=" Chart "><img src="ftp://example.com/a.png"><img src="data:text/html;base64,PGI+" alt="Data">`,
+			want:    `<img src="https://example.com/blog/pic.png" alt="Pic"/><em>Chart</em><em>Data</em>`,
+		},
+		{
+			name:    "list items outside of lists",
+			content: `<li value="3">item</li><dd>description</dd><dl><dt>term</dt></dl>`,
+			want:    `<p>item</p><p>description</p><dl><dt>term</dt></dl>`,
+		},
+		{
+			name:    "characters XML doesn't allow",
+			content: "<p title=\"a\x01b\">c\x0bd\ufffee</p>",
+			want:    `<p title="ab">cde</p>`,
+		},
+	}
+
+	base := mustParseURL(t, "https://example.com/blog/post")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeContent(tt.content, base); got != tt.want {
+				t.Errorf("sanitizeContent(%q)\n = %q\nwant %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeContentIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "invalid ids",
+			content: `<p id="1st">a</p><p id=" a b ">b</p><p id="é:x">c</p><p id="-">d</p><p id="  ">e</p>`,
+			want:    `<p id="id-1st">a</p><p id="a-b">b</p><p id="é-x">c</p><p id="id--">d</p><p>e</p>`,
+		},
+		{
+			name:    "ids reserved for notes",
+			content: `<p id="note-1">a</p>`,
+			want:    `<p id="article-note-1">a</p>`,
+		},
+		{
+			name:    "collisions",
+			content: `<p id="x-2">a</p><p id="x">b</p><p id="x">c</p><p id="x">d</p>`,
+			want:    `<p id="x-2">a</p><p id="x">b</p><p id="x-3">c</p><p id="x-4">d</p>`,
+		},
+		{
+			name:    "collisions after cleaning",
+			content: `<p id="a b">a</p><p id="a-b">b</p>`,
+			want:    `<p id="a-b">a</p><p id="a-b-2">b</p>`,
+		},
+		{
+			name:    "links follow remapped ids",
+			content: `<a href="#1st">one</a><a href="#a b">two</a><a href="#x">three</a><a href="#missing">four</a><p id="x">a</p><p id="x">b</p><p id="1st">c</p><p id="a b">d</p>`,
+			want:    `<a href="#id-1st">one</a><a href="#a-b">two</a><a href="#x">three</a><a href="#missing">four</a><p id="x">a</p><p id="x-2">b</p><p id="id-1st">c</p><p id="a-b">d</p>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeContent(tt.content, nil); got != tt.want {
+				t.Errorf("sanitizeContent(%q)\n = %q\nwant %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextOnly(t *testing.T) {
+	content := "<h1>Title</h1><p>One <em>two</em>\n three</p><script>var x = 1;</script><ul><li>a &amp; b</li><li>c</li></ul>text<br>after"
+	want := "<p>Title</p>\n<p>One two three</p>\n<p>a &amp; b</p>\n<p>c</p>\n<p>text</p>\n<p>after</p>\n"
+
+	if got := textOnly(content); got != want {
+		t.Errorf("textOnly = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+type ServerConfig struct {
+	Listen         string `yaml:"listen"`
+	Token          string `yaml:"token"`
+	RestartXochitl bool   `yaml:"restartXochitl"`
+	// ConfigUI serves the setup page on /config to the USB network
+	ConfigUI bool `yaml:"configUI"`
+}
+
+// Server lets a browser or phone push articles to the tablet over the
+// network, running them through the same conversion as a sync
+type Server struct {
+	mu         sync.Mutex
+	recent     []SyncResult
+	configUI   bool
+	pocketAuth *pendingPocketAuth
+	csrfToken  string // for the forms of the config and index pages, new on every start
+	session    string // the cookie of browsers that logged in with the token
+}
+
+type serverStatus struct {
+	Queue      []QueueItem  `json:"queue"`
+	QueueError string       `json:"queueError,omitempty"`
+	LastSync   *SyncSummary `json:"lastSync"`
+	Recent     []SyncResult `json:"recent"`
+}
+
+const serverMaxRecent = 20
+const serverMaxBody = 10 << 20
+const sessionCookie = "pocket2rm-session"
+
+// StartServer serves the push endpoints, which stay locked without a token,
+// and the setup page when configUI is set
+func StartServer(config ServerConfig, configUI bool) error {
+	listen := config.Listen
+	if listen == "" {
+		listen = usbAddress + ":8080"
+	}
+
+	fmt.Println("listening on", listen)
+	return http.ListenAndServe(listen, (&Server{configUI: configUI}).Handler())
+}
+
+func (srv *Server) Handler() http.Handler {
+	if srv.csrfToken == "" {
+		srv.csrfToken = newCSRFToken()
+	}
+	if srv.session == "" {
+		srv.session = newCSRFToken()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", srv.handleIndex)
+	mux.HandleFunc("/add", srv.handleAdd)
+	mux.HandleFunc("/status", srv.handleStatus)
+	if srv.configUI {
+		mux.HandleFunc("/config", srv.handleConfig)
+		mux.HandleFunc("/config/pocket/connect", srv.handlePocketConnect)
+		mux.HandleFunc("/config/pocket/callback", srv.handlePocketCallback)
+		mux.HandleFunc("/config/sync", srv.handleSync)
+	}
+	return mux
+}
+
+// authorized takes the token from the Authorization header or a POST body,
+// never from the URL where it ends up in histories and logs, or the session
+// of a browser that logged in on the index page
+func (srv *Server) authorized(r *http.Request) bool {
+	token := GetAppConfig().Server.Token
+	if token == "" {
+		return false
+	}
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if given == "" && r.Method == http.MethodPost {
+		given = r.PostFormValue("token")
+	}
+	if given != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+	}
+	return srv.validSession(r)
+}
+
+// validSession checks the session cookie; a POST with it must also come
+// from the index page's form, the cookie alone could be sent by other sites
+func (srv *Server) validSession(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(srv.session)) != 1 {
+		return false
+	}
+	return r.Method != http.MethodPost || subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(srv.csrfToken)) == 1
+}
+
+func (srv *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, serverMaxBody)
+	if !srv.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pageURL := r.PostFormValue("url")
+	rawHTML := r.PostFormValue("html")
+	if pageURL == "" && rawHTML == "" {
+		http.Error(w, "url or html is required", http.StatusBadRequest)
+		return
+	}
+
+	config := GetAppConfig()
+	svc, err := GetService(config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// one delivery at a time, the conversion is heavy enough on the tablet
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	rm := Remarkable{Config: svc.GetRemarkableConfig()}
+	if !rm.TargetFolderExists() {
+		fmt.Println("no target folder")
+		rm.GenerateTargetFolder()
+		svc, _ = GetService(GetAppConfig())
+	}
+
+	opts := AddOptions{Save: r.PostFormValue("save") != "0"}
+	var summary *SyncSummary
+	if rawHTML != "" {
+		summary = AddHTML(r.Context(), svc, rawHTML, pageURL, opts)
+	} else {
+		summary = AddURLs(r.Context(), svc, []string{pageURL}, opts)
+	}
+
+	srv.recent = append(summary.Results, srv.recent...)
+	if len(srv.recent) > serverMaxRecent {
+		srv.recent = srv.recent[:serverMaxRecent]
+	}
+
+	if config.Server.RestartXochitl && len(summary.Results) > 0 && !summary.Results[0].Skipped {
+		restartXochitl()
+	}
+
+	if r.PostFormValue("redirect") != "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summary)
+}
+
+func (srv *Server) status(ctx context.Context) serverStatus {
+	status := serverStatus{LastSync: GetLastSync()}
+
+	svc, err := GetService(GetAppConfig())
+	if err == nil {
+		status.Queue, err = svc.Queue(ctx, GetAppConfig().GetMaxArticles())
+	}
+	if err != nil {
+		status.QueueError = err.Error()
+	}
+
+	srv.mu.Lock()
+	status.Recent = append([]SyncResult{}, srv.recent...)
+	srv.mu.Unlock()
+
+	return status
+}
+
+func (srv *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(srv.status(r.Context()))
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta name="viewport" content="width=device-width, initial-scale=1"><title>pocket2rm</title></head>
+<body>
+<h1>pocket2rm</h1>
+<form method="post" action="/add">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="redirect" value="1">
+<input type="url" name="url" placeholder="https://..." size="50" required>
+<button type="submit">Send to reMarkable</button>
+</form>
+<h2>Queue</h2>
+{{if .Status.QueueError}}<p>Could not get queue: {{.Status.QueueError}}</p>{{end}}
+<ul>{{range .Status.Queue}}<li><a href="{{.URL}}">{{.Title}}</a></li>{{else}}<li>empty</li>{{end}}</ul>
+<h2>Recently sent</h2>
+<ul>{{range .Status.Recent}}<li>{{template "result" .}}</li>{{else}}<li>nothing yet</li>{{end}}</ul>
+<h2>Last sync</h2>
+{{with .Status.LastSync}}<p>{{.Started.Format "2006-01-02 15:04"}}{{with .RateLimitedUntil}}, rate limited until {{.Format "2006-01-02 15:04"}}{{end}}</p>
+<ul>{{range .Results}}<li>{{template "result" .}}</li>{{end}}</ul>{{else}}<p>no sync yet</p>{{end}}
+</body>
+</html>
+{{define "login"}}<!DOCTYPE html>
+<html>
+<head><meta name="viewport" content="width=device-width, initial-scale=1"><title>pocket2rm</title></head>
+<body>
+<h1>pocket2rm</h1>
+<form method="post" action="/">
+<input type="password" name="token" placeholder="token" required>
+<button type="submit">Log in</button>
+</form>
+{{if .}}<p><a href="/config">Setup</a></p>{{end}}
+</body>
+</html>
+{{end}}
+{{define "result"}}{{if .Skipped}}skipped <a href="{{.URL}}">{{or .Title .URL}}</a>: {{.Reason}}{{else}}{{.FileType}} <a href="{{.URL}}">{{.VisibleName}}</a>{{end}}{{end}}`))
+
+func (srv *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	setup := srv.configUI && fromUSB(r)
+	if setup && GetAppConfig().Server.Token == "" {
+		http.Redirect(w, r, "/config", http.StatusSeeOther)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, serverMaxBody)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if r.Method == http.MethodPost {
+		// logging in, the browser keeps a session instead of the token
+		if !srv.authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = indexTemplate.ExecuteTemplate(w, "login", setup)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: srv.session, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if !srv.validSession(r) {
+		_ = indexTemplate.ExecuteTemplate(w, "login", setup)
+		return
+	}
+
+	_ = indexTemplate.Execute(w, struct {
+		CSRF   string
+		Status serverStatus
+	}{srv.csrfToken, srv.status(r.Context())})
+}
+
+func restartXochitl() {
+	cmd := exec.Command("systemctl", "restart", "xochitl")
+	cmd.Run()
+}
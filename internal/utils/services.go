@@ -1,80 +1,133 @@
 package utils
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/bmaupin/go-epub"
-	"github.com/go-shiori/dom"
 	"github.com/go-shiori/go-readability"
-	"github.com/google/uuid"
-	"golang.org/x/net/html"
 )
 
-func cleanDuplicateAttributes(doc *html.Node, attrName string) string {
-	var cleanId func(*html.Node, int)
+func createEpubFileContent(ctx context.Context, config *AppConfig, title string, content string, meta articleMetadata) []byte {
+	e := epub.NewEpub(title)
+	setEpubMetadata(e, meta)
+	addEpubCover(ctx, config, e, title, meta, content)
+	addChapters(e, title, addImages(e, content), addEpubStyle(e, config.GetStyle()))
 
-	cleanId = func(node *html.Node, idx int) {
-		attribute := dom.GetAttribute(node, attrName)
-		dom.RemoveAttribute(node, attrName)
-		dom.SetAttribute(node, attrName, attribute)
-	}
+	return epubFileContent(e, meta)
+}
 
-	nodeList := dom.QuerySelectorAll(doc, "["+attrName+"]")
-	dom.ForEachNode(nodeList, cleanId)
+// newArticleDocument cleans the XHTML of an article and wraps it, with its
+// header and footer, in an epub, or lays it out as a PDF for articles that
+// should be annotated. An epub that fails the check is rebuilt from the
+// article's text alone.
+func newArticleDocument(ctx context.Context, config *AppConfig, title string, content string, meta articleMetadata) (document, error) {
+	base, _ := url.Parse(meta.Source)
+	content = inlineImages(ctx, config.Images, sanitizeContent(withFrontMatter(config.ArticleTemplate, title, meta, content), base), base)
+	if config.LinkNotes {
+		content = linkNotes(content, meta.Source)
+	}
+	if config.GetFormat(meta.Tags) == "pdf" {
+		fileContent, err := renderPDF(title, content, meta, config.PDF)
+		if err == nil {
+			return document{title: title, fileType: "pdf", content: fileContent, html: content, meta: meta}, nil
+		}
+		fmt.Println(fmt.Sprintf("Could not render PDF of '%s', using an epub: %s", title, err))
+	}
 
-	return dom.OuterHTML(doc)
+	doc := document{title: title, fileType: "epub", content: createEpubFileContent(ctx, config, title, content, meta), html: content, meta: meta}
+	err := checkDocument(doc)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("Epub of '%s' is broken, keeping only its text: %s", title, err))
+		doc.html = textOnly(content)
+		doc.content = createEpubFileContent(ctx, config, title, doc.html, meta)
+		err = checkDocument(doc)
+	}
+	return doc, err
 }
 
-func createEpubFileContent(title string, content string, author string) []byte {
-	e := epub.NewEpub(title)
-	e.SetAuthor(author)
-	_, _ = e.AddSection(content, title, "", "")
-
-	tmpName := "/tmp/epub" + uuid.New().String()[0:5] + ".epub"
-	_ = e.Write(tmpName)
-	defer os.Remove(tmpName)
+func epubFileContent(e *epub.Epub, meta articleMetadata) []byte {
+	var buf bytes.Buffer
+	_, _ = e.WriteTo(&buf)
 
-	fileContent, _ := os.ReadFile(tmpName)
+	fileContent, err := addOPFMetadata(buf.Bytes(), meta)
+	if err != nil {
+		fmt.Println("Could not add epub metadata:", err)
+		return buf.Bytes()
+	}
 	return fileContent
 }
 
-func createPDFFileContent(url string) []byte {
-	resp, _ := http.Get(url)
-	defer resp.Body.Close()
-	content, _ := io.ReadAll(resp.Body)
-	return content
+// document is an article converted into a file the tablet can open
+type document struct {
+	title    string
+	fileType string // "epub" or "pdf"
+	content  []byte
+	path     string // set instead of content for files streamed to disk
+	html     string // the article's XHTML, for documents made from a page
+	meta     articleMetadata
 }
 
-// generate filename from time added and title
-func getFilename(timeAdded time.Time, title string) string {
-	// fileType: "epub" or "pdf"
-	fileName := fmt.Sprintf("%s :: %s", timeAdded.Format("20060102-1504"), title)
-	return fileName
+func (d document) size() int64 {
+	if d.path != "" {
+		info, err := os.Stat(d.path)
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	return int64(len(d.content))
 }
 
-func getReadableArticle(url *url.URL) (string, string, error) {
-	timeout, _ := time.ParseDuration("30s")
-	article, err := readability.FromURL(url.String(), timeout)
+// remove deletes the downloaded file, if any, once it is not needed anymore
+func (d document) remove() {
+	if d.path != "" {
+		_ = os.Remove(d.path)
+	}
+}
+
+// convertURL downloads u and converts it according to its content type;
+// meta is what the service knows about the article
+func convertURL(ctx context.Context, config *AppConfig, u *url.URL, meta articleMetadata) (document, error) {
+	meta = meta.fill(articleMetadata{Source: u.String(), Saved: time.Now()})
+	doc, ok, err := extractURL(ctx, config, u, meta)
+	if ok {
+		return doc, err
+	}
 
+	f, err := fetchContent(ctx, u)
 	if err != nil {
-		return "", "", err
+		return document{}, fmt.Errorf("could not download: %w", err)
 	}
+	defer f.Close()
 
-	// Strip duplicate attributes from tags
-	if article.Node != nil {
-		article.Content = cleanDuplicateAttributes(article.Node, "id")
-		article.Content = cleanDuplicateAttributes(article.Node, "alt")
+	f.meta = meta
+	return convertFetched(f, config)
+}
+
+// convertHTML turns a page that was already downloaded (e.g. pushed from a
+// browser) into a readable epub
+func convertHTML(ctx context.Context, config *AppConfig, rawHTML string, u *url.URL) (document, error) {
+	article, err := readability.FromReader(strings.NewReader(rawHTML), u)
+	if err != nil {
+		return document{}, fmt.Errorf("could not get readable article: %w", err)
 	}
 
-	// Include title and source URL in beginning of content
-	content := fmt.Sprintf(`<h1> %s </h1>
-		<a href="%s">%s</a>
-		%s`, article.Title, url.String(), url.String(), article.Content)
+	meta := readabilityMetadata(article, u).fill(articleMetadata{Saved: time.Now()})
+	return newArticleDocument(ctx, config, article.Title, article.Content, meta)
+}
 
-	return article.Title, content, nil
+// fileTitle guesses a title for a downloaded file from its name
+func fileTitle(u *url.URL) string {
+	title := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	if title == "" || title == "." || title == "/" {
+		return u.Host
+	}
+	return title
 }
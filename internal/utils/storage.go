@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrDocumentTooLarge = errors.New("document too large")
+	ErrNotEnoughSpace   = errors.New("not enough free space on the tablet")
+)
+
+// StorageLimits keep a sync from filling up the tablet's small /home partition
+type StorageLimits struct {
+	MaxDocumentSize int64
+	MinFreeSpace    int64
+}
+
+// checkStorage fails when doc is over the size limit or writing it would
+// leave less than the minimum free space in dir. A downloaded file is
+// already on the partition and only renamed into place, saveBody checked
+// the space it takes.
+func checkStorage(dir string, doc document, limits StorageLimits) error {
+	size := doc.size()
+	if limits.MaxDocumentSize > 0 && size > limits.MaxDocumentSize {
+		return fmt.Errorf("%w: %s, the limit is %s", ErrDocumentTooLarge, formatSize(size), formatSize(limits.MaxDocumentSize))
+	}
+
+	needed := size
+	if doc.path != "" {
+		needed = 0
+	}
+	free, ok := freeSpace(dir)
+	if ok && free-needed < limits.MinFreeSpace {
+		return fmt.Errorf("%w: %s free, %s needed and %s kept free", ErrNotEnoughSpace, formatSize(free), formatSize(needed), formatSize(limits.MinFreeSpace))
+	}
+
+	return nil
+}
+
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+}
+
+func downloadsPath() string {
+	userHomeDir := getUserHomeDir()
+
+	// same partition as the xochitl folder, so downloads can be renamed into place
+	return filepath.Join(userHomeDir, ".pocket2rm-downloads")
+}
+
+// saveBody streams a response body to a file in the downloads folder and
+// returns its path; nothing bigger than the maximum document size or than
+// what the minimum free space leaves is kept
+func saveBody(body io.Reader, contentLength int64, limits StorageLimits) (string, error) {
+	maxSize := limits.MaxDocumentSize
+	if maxSize > 0 && contentLength > maxSize {
+		return "", fmt.Errorf("%w: %s, the limit is %s", ErrDocumentTooLarge, formatSize(contentLength), formatSize(maxSize))
+	}
+
+	err := os.MkdirAll(downloadsPath(), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// checked before downloading when the size is known, and the download
+	// is stopped when it turns out bigger
+	limit, spaceLimited := maxSize, false
+	if free, ok := freeSpace(downloadsPath()); ok {
+		if contentLength > 0 && free-contentLength < limits.MinFreeSpace {
+			return "", fmt.Errorf("%w: %s free, %s needed and %s kept free", ErrNotEnoughSpace, formatSize(free), formatSize(contentLength), formatSize(limits.MinFreeSpace))
+		}
+		available := free - limits.MinFreeSpace
+		if available < 0 {
+			available = 0
+		}
+		if limit <= 0 || available < limit {
+			limit, spaceLimited = available, true
+		}
+	}
+
+	fileName := filepath.Join(downloadsPath(), uuid.New().String())
+	f, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	limited := limit > 0 || spaceLimited
+	if limited {
+		body = io.LimitReader(body, limit+1)
+	}
+	written, err := io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limited && written > limit {
+		if spaceLimited {
+			err = fmt.Errorf("%w: less than %s kept free", ErrNotEnoughSpace, formatSize(limits.MinFreeSpace))
+		} else {
+			err = fmt.Errorf("%w: more than %s", ErrDocumentTooLarge, formatSize(maxSize))
+		}
+	}
+	if err != nil {
+		_ = os.Remove(fileName)
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+// cleanDownloads removes downloads left behind by an interrupted run; it
+// must only be called with the exclusive lock
+func cleanDownloads() {
+	downloads, _ := os.ReadDir(downloadsPath())
+	for _, entry := range downloads {
+		_ = os.Remove(filepath.Join(downloadsPath(), entry.Name()))
+	}
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmaupin/go-epub"
+)
+
+// StyleConfig is the look of the generated epubs; without it they get
+// defaultCSS and the tablet's fonts
+type StyleConfig struct {
+	CSS   string       `yaml:"css,omitempty"` // path to a stylesheet used instead of the built-in one
+	Fonts []FontConfig `yaml:"fonts,omitempty"`
+}
+
+// FontConfig is a font file embedded in every epub, the first family is
+// used for the text
+type FontConfig struct {
+	Family string `yaml:"family"`
+	File   string `yaml:"file"`             // .ttf or .otf
+	Weight string `yaml:"weight,omitempty"` // e.g. "bold", default "normal"
+	Style  string `yaml:"style,omitempty"`  // e.g. "italic", default "normal"
+}
+
+// defaultCSS is made for e-ink: black text, no colors or backgrounds that
+// turn into gray, and code and tables that stay within the page
+const defaultCSS = `body { margin: 0 0.5em; line-height: 1.45; }
+h1, h2, h3, h4 { line-height: 1.2; margin: 1.2em 0 0.5em; page-break-after: avoid; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 1.35em; }
+h3 { font-size: 1.15em; }
+p { margin: 0 0 0.8em; }
+a { color: black; }
+img { max-width: 100%; height: auto; }
+figure { margin: 1em 0; }
+figcaption { font-size: 0.85em; font-style: italic; }
+blockquote { margin: 1em 0; padding-left: 1em; border-left: 0.2em solid black; font-style: italic; }
+code, pre, kbd, samp { font-family: monospace; font-size: 0.85em; }
+pre { white-space: pre-wrap; word-wrap: break-word; margin: 1em 0; padding: 0.5em; border: 1px solid black; }
+pre code { font-size: 1em; }
+table { border-collapse: collapse; width: 100%; margin: 1em 0; font-size: 0.9em; }
+th, td { border: 1px solid black; padding: 0.2em 0.4em; text-align: left; vertical-align: top; }
+th { font-weight: bold; }
+img.qr { width: 25%; }
+hr { border: none; border-top: 1px solid black; margin: 1.5em 0; }
+`
+
+// addEpubStyle adds the stylesheet and fonts of the configured style and
+// returns the stylesheet's path for the sections
+func addEpubStyle(e *epub.Epub, style StyleConfig) string {
+	var css strings.Builder
+	var families []string
+	for _, font := range style.Fonts {
+		fontPath, err := e.AddFont(font.File, filepath.Base(font.File))
+		if err != nil {
+			fmt.Println(fmt.Sprintf("Could not add font %s: %s", font.File, err))
+			continue
+		}
+		css.WriteString(fmt.Sprintf("@font-face { font-family: %q; src: url(%q); font-weight: %s; font-style: %s; }\n",
+			font.Family, fontPath, orDefault(font.Weight, "normal"), orDefault(font.Style, "normal")))
+		families = append(families, font.Family)
+	}
+	if len(families) > 0 {
+		css.WriteString(fmt.Sprintf("body { font-family: %q, serif; }\n", families[0]))
+	}
+
+	stylesheet := defaultCSS
+	if style.CSS != "" {
+		content, err := os.ReadFile(style.CSS)
+		if err != nil {
+			fmt.Println("Could not read stylesheet, using the default one:", err)
+		} else {
+			stylesheet = string(content)
+		}
+	}
+	css.WriteString(stylesheet)
+
+	cssPath, err := e.AddCSS("data:text/css;base64,"+base64.StdEncoding.EncodeToString([]byte(css.String())), "style.css")
+	if err != nil {
+		fmt.Println("Could not add stylesheet:", err)
+		return ""
+	}
+	return cssPath
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
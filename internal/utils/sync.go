@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// SyncOptions controls a single run of ReaderService.GenerateFiles
+type SyncOptions struct {
+	MaxArticles uint
+	// Concurrency is the number of articles fetched and converted at once
+	Concurrency uint
+	// DryRun runs the whole sync without writing documents to the tablet
+	// or marking items as handled upstream
+	DryRun bool
+	// Digest bundles the articles of the sync into a single epub
+	Digest bool
+}
+
+type SyncResult struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	VisibleName string `json:"visibleName,omitempty"`
+	FileType    string `json:"fileType,omitempty"` // "epub" or "pdf"
+	Skipped     bool   `json:"skipped"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type SyncSummary struct {
+	Service          string       `json:"service"`
+	DryRun           bool         `json:"dryRun"`
+	Started          time.Time    `json:"started"`
+	Results          []SyncResult `json:"results"`
+	RateLimitedUntil *time.Time   `json:"rateLimitedUntil,omitempty"`
+	// Interrupted is set when the sync was cancelled or ran out of time
+	Interrupted string `json:"interrupted,omitempty"`
+	// Warnings are problems of the sync that concern no single result
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// QueueItem is an item waiting in the service to be delivered by the next sync
+type QueueItem struct {
+	Title   string    `json:"title"`
+	URL     string    `json:"url"`
+	SavedAt time.Time `json:"savedAt"`
+}
+
+func newSyncSummary(service string, opts SyncOptions) *SyncSummary {
+	return &SyncSummary{Service: service, DryRun: opts.DryRun, Started: time.Now()}
+}
+
+func (s *SyncSummary) addDocument(title string, url string, visibleName string, fileType string) {
+	s.Results = append(s.Results, SyncResult{Title: title, URL: url, VisibleName: visibleName, FileType: fileType})
+}
+
+func (s *SyncSummary) addSkipped(title string, url string, reason string) {
+	s.Results = append(s.Results, SyncResult{Title: title, URL: url, Skipped: true, Reason: reason})
+}
+
+// finish records why the sync stopped early, if it did
+func (s *SyncSummary) finish(ctx context.Context) {
+	if ctx.Err() != nil {
+		s.Interrupted = ctx.Err().Error()
+	}
+}
+
+func (s *SyncSummary) addWarning(warning string) {
+	fmt.Println(warning)
+	s.Warnings = append(s.Warnings, warning)
+}
+
+// noteError keeps track of errors that concern the whole sync rather than
+// a single item, for now only rate limits
+func (s *SyncSummary) noteError(err error) {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		if s.RateLimitedUntil == nil || rateLimitErr.Until.After(*s.RateLimitedUntil) {
+			s.RateLimitedUntil = &rateLimitErr.Until
+		}
+	}
+}
+
+func (s *SyncSummary) Print() {
+	if s.DryRun {
+		fmt.Println("dry-run: nothing was written to the tablet and no items were marked as handled")
+	}
+
+	for _, result := range s.Results {
+		if result.Skipped && result.Title == "" {
+			fmt.Println(fmt.Sprintf("skip  %s: %s", result.URL, result.Reason))
+		} else if result.Skipped {
+			fmt.Println(fmt.Sprintf("skip  %s (%s): %s", result.Title, result.URL, result.Reason))
+		} else {
+			fmt.Println(fmt.Sprintf("%-5s %s (%s)", result.FileType, result.VisibleName, result.URL))
+		}
+	}
+
+	if s.Interrupted != "" {
+		fmt.Println("sync interrupted:", s.Interrupted)
+	}
+
+	for _, warning := range s.Warnings {
+		fmt.Println("warning:", warning)
+	}
+
+	if s.RateLimitedUntil != nil {
+		fmt.Println(fmt.Sprintf("rate limited until %s", s.RateLimitedUntil.Format("2006-01-02 15:04:05")))
+	}
+}
+
+func getLastSyncPath() string {
+	userHomeDir := getUserHomeDir()
+
+	return filepath.Join(userHomeDir, ".pocket2rm-last-sync.json")
+}
+
+// WriteLastSync keeps the summary around for the reload daemon to show
+func WriteLastSync(summary *SyncSummary) {
+	content, _ := json.Marshal(summary)
+	_ = os.WriteFile(getLastSyncPath(), content, 0644)
+}
+
+func GetLastSync() *SyncSummary {
+	fileContent, err := os.ReadFile(getLastSyncPath())
+	if err != nil {
+		return nil
+	}
+
+	var summary *SyncSummary
+	_ = json.Unmarshal(fileContent, &summary)
+	return summary
+}
+
+func getSyncRequestPath() string {
+	userHomeDir := getUserHomeDir()
+
+	return filepath.Join(userHomeDir, ".pocket2rm-sync-requested")
+}
+
+// RequestSync starts a sync even though the reload file is still present
+func RequestSync() {
+	_ = os.WriteFile(getSyncRequestPath(), []byte{}, 0644)
+	cmd := exec.Command("systemctl", "restart", "pocket2rm")
+	cmd.Run()
+}
+
+// SyncRequested reports (and clears) a pending RequestSync
+func SyncRequested() bool {
+	err := os.Remove(getSyncRequestPath())
+	return err == nil
+}
+
+// documentWriter is where GenerateFiles puts its documents. Remarkable
+// writes them into the xochitl directory and dryRunWriter discards them.
+// writeDocument takes over the document: any downloaded file of it is
+// moved or removed.
+type documentWriter interface {
+	writeDocument(visibleName string, doc document) (string, error)
+}
+
+type dryRunWriter struct {
+	rm Remarkable
+}
+
+func (w dryRunWriter) writeDocument(visibleName string, doc document) (string, error) {
+	defer doc.remove()
+
+	err := checkStorage(w.rm.articeFolderPath(), doc, w.rm.Limits)
+	if err != nil {
+		return "", err
+	}
+	err = checkDocument(doc)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println(fmt.Sprintf("dry-run: would write %s %q (%s)", doc.fileType, visibleName, formatSize(doc.size())))
+	return "", nil
+}
+
+func newDocumentWriter(limits StorageLimits, config *RemarkableConfig, opts SyncOptions) documentWriter {
+	rm := Remarkable{Config: config, Limits: limits}
+	if opts.DryRun {
+		return dryRunWriter{rm}
+	}
+	return rm
+}
+
+// convertInOrder converts count items with up to concurrency workers and
+// hands the results to handle one at a time, in the order of the items, so
+// writing documents and updating the service stays serialized. No new
+// conversion is started once handle returns false or ctx is done; the
+// conversions still running then are waited for and their documents removed.
+func convertInOrder(ctx context.Context, count int, concurrency uint, convert func(i int) (document, error), handle func(i int, doc document, err error) bool) {
+	type converted struct {
+		doc document
+		err error
+	}
+
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	results := make([]chan converted, count)
+	for i := range results {
+		results[i] = make(chan converted, 1)
+	}
+
+	// a slot is taken when a conversion starts and given back once its
+	// result was handled, so at most concurrency results wait at any time
+	slots := make(chan struct{}, concurrency)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	started := 0
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			started++
+			go func(i int) {
+				doc, err := convert(i)
+				results[i] <- converted{doc, err}
+			}(i)
+		}
+	}()
+
+	// drain stops starting conversions and removes the documents of those
+	// from item from on that were started but won't be handled
+	drain := func(from int) {
+		close(stop)
+		<-done
+		for i := from; i < started; i++ {
+			result := <-results[i]
+			result.doc.remove()
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		var result converted
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			drain(i)
+			return
+		}
+		if ctx.Err() != nil {
+			result.doc.remove()
+			drain(i + 1)
+			return
+		}
+
+		ok := handle(i, result.doc, result.err)
+		<-slots
+		if !ok {
+			drain(i + 1)
+			return
+		}
+	}
+}
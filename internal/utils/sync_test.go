@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fileConverter converts items to empty files in a temporary directory,
+// later items finishing first, and counts the conversions that are running
+// or waiting to be handled
+type fileConverter struct {
+	dir         string
+	outstanding int32
+	maxWaiting  int32
+	running     int32
+}
+
+func newFileConverter(t *testing.T) *fileConverter {
+	return &fileConverter{dir: t.TempDir()}
+}
+
+func (c *fileConverter) path(i int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%d.epub", i))
+}
+
+func (c *fileConverter) convert(i int) (document, error) {
+	atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	waiting := atomic.AddInt32(&c.outstanding, 1)
+	for {
+		max := atomic.LoadInt32(&c.maxWaiting)
+		if waiting <= max || atomic.CompareAndSwapInt32(&c.maxWaiting, max, waiting) {
+			break
+		}
+	}
+
+	time.Sleep(time.Duration(10-i%5) * time.Millisecond)
+	if i%3 == 1 {
+		return document{}, fmt.Errorf("item %d", i)
+	}
+	path := c.path(i)
+	err := os.WriteFile(path, nil, 0644)
+	return document{path: path}, err
+}
+
+// handled takes a moment, like writing a document, before the result counts
+// as handled
+func (c *fileConverter) handled() {
+	time.Sleep(2 * time.Millisecond)
+	atomic.AddInt32(&c.outstanding, -1)
+}
+
+// files returns the items whose files exist
+func (c *fileConverter) files(count int) []int {
+	var items []int
+	for i := 0; i < count; i++ {
+		if _, err := os.Stat(c.path(i)); err == nil {
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+func TestConvertInOrder(t *testing.T) {
+	for _, concurrency := range []uint{0, 1, 3, 8} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			c := newFileConverter(t)
+			var order []int
+			convertInOrder(context.Background(), 12, concurrency, c.convert, func(i int, doc document, err error) bool {
+				c.handled()
+				order = append(order, i)
+				if (err != nil) != (i%3 == 1) {
+					t.Errorf("item %d: err = %v", i, err)
+				}
+				return true
+			})
+
+			want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+			if !reflect.DeepEqual(order, want) {
+				t.Errorf("handled %v, want %v", order, want)
+			}
+			limit := int32(concurrency)
+			if limit == 0 {
+				limit = 1
+			}
+			if c.maxWaiting > limit {
+				t.Errorf("%d conversions were running or waiting, want at most %d", c.maxWaiting, limit)
+			}
+		})
+	}
+}
+
+func TestConvertInOrderStop(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(i int, cancel context.CancelFunc) bool
+		want   []int
+	}{
+		{
+			name: "handle returns false",
+			handle: func(i int, cancel context.CancelFunc) bool {
+				return i < 3
+			},
+			want: []int{0, 2, 3},
+		},
+		{
+			name: "context canceled",
+			handle: func(i int, cancel context.CancelFunc) bool {
+				if i == 3 {
+					cancel()
+				}
+				return true
+			},
+			want: []int{0, 2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := newFileConverter(t)
+			var order []int
+			convertInOrder(ctx, 12, 4, c.convert, func(i int, doc document, err error) bool {
+				c.handled()
+				order = append(order, i)
+				return tt.handle(i, cancel)
+			})
+
+			if !reflect.DeepEqual(order, []int{0, 1, 2, 3}) {
+				t.Errorf("handled %v", order)
+			}
+			if running := atomic.LoadInt32(&c.running); running != 0 {
+				t.Errorf("%d conversions still running", running)
+			}
+			// a conversion that wasn't waited for would write its file by now
+			time.Sleep(20 * time.Millisecond)
+			// only the documents that were handled are left
+			if files := c.files(12); !reflect.DeepEqual(files, tt.want) {
+				t.Errorf("files of items %v left, want %v", files, tt.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,233 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type AppConfig struct {
-	Service  string         `yaml:"service"`
-	Pocket   PocketConfig   `yaml:"pocket,omitempty"`
-	Omnivore OmnivoreConfig `yaml:"omnivore,omitempty"`
+	Service       string      `yaml:"service"`
+	MaxArticles   uint        `yaml:"maxArticles,omitempty"`
+	SyncInterval  string      `yaml:"syncInterval,omitempty"`  // e.g. "6h"; empty only syncs on reload file removal
+	Concurrency   uint        `yaml:"concurrency,omitempty"`   // articles fetched and converted at once
+	SyncTimeout   string      `yaml:"syncTimeout,omitempty"`   // total time a sync may take, default 15m
+	MaxDocumentMB uint        `yaml:"maxDocumentMB,omitempty"` // larger documents are skipped, default 100
+	MinFreeMB     uint        `yaml:"minFreeMB,omitempty"`     // free space kept on the tablet, default 300
+	Covers        *bool       `yaml:"covers,omitempty"`        // generate epub covers, default true
+	PDFCovers     bool        `yaml:"pdfCovers,omitempty"`     // also put a cover page in front of PDFs
+	Digest        bool        `yaml:"digest,omitempty"`        // one epub per sync instead of one per article
+	Style         StyleConfig `yaml:"style,omitempty"`         // stylesheet and fonts, unless the service has its own
+	Images        ImageConfig `yaml:"images,omitempty"`
+	Format        string      `yaml:"format,omitempty"` // "epub" (default) or "pdf", unless the service has its own
+	PDF           PDFConfig   `yaml:"pdf,omitempty"`
+	LinkNotes     bool        `yaml:"linkNotes,omitempty"`    // links become numbered notes with QR codes
+	NameTemplate  string      `yaml:"nameTemplate,omitempty"` // text/template for document names
+	TimeZone      string      `yaml:"timeZone,omitempty"`     // of the dates in names, e.g. "Europe/Berlin"
+	// html/template file redefining the "header" and/or "footer" of articles
+	ArticleTemplate string         `yaml:"articleTemplate,omitempty"`
+	Pocket          PocketConfig   `yaml:"pocket,omitempty"`
+	Omnivore        OmnivoreConfig `yaml:"omnivore,omitempty"`
+	Server          ServerConfig   `yaml:"server,omitempty"`
+}
+
+const defaultMaxArticles uint = 10
+const defaultConcurrency uint = 3
+const defaultSyncTimeout = 15 * time.Minute
+const defaultMaxDocumentMB uint = 100
+const defaultMinFreeMB uint = 300
+
+func (cfg *AppConfig) GetMaxArticles() uint {
+	if cfg.MaxArticles == 0 {
+		return defaultMaxArticles
+	}
+	return cfg.MaxArticles
+}
+
+func (cfg *AppConfig) GetConcurrency() uint {
+	if cfg.Concurrency == 0 {
+		return defaultConcurrency
+	}
+	return cfg.Concurrency
+}
+
+func (cfg *AppConfig) GetSyncTimeout() time.Duration {
+	timeout, err := time.ParseDuration(cfg.SyncTimeout)
+	if err != nil || timeout <= 0 {
+		return defaultSyncTimeout
+	}
+	return timeout
+}
+
+func (cfg *AppConfig) GetStorageLimits() StorageLimits {
+	maxDocumentMB, minFreeMB := cfg.MaxDocumentMB, cfg.MinFreeMB
+	if maxDocumentMB == 0 {
+		maxDocumentMB = defaultMaxDocumentMB
+	}
+	if minFreeMB == 0 {
+		minFreeMB = defaultMinFreeMB
+	}
+	return StorageLimits{int64(maxDocumentMB) << 20, int64(minFreeMB) << 20}
+}
+
+func (cfg *AppConfig) GetCovers() bool {
+	return cfg.Covers == nil || *cfg.Covers
+}
+
+func (cfg *AppConfig) GetNameTemplate() string {
+	if cfg.NameTemplate == "" {
+		return defaultNameTemplate
+	}
+	return cfg.NameTemplate
+}
+
+func (cfg *AppConfig) GetTimeZone() *time.Location {
+	if cfg.TimeZone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// GetStyle returns the style of the active service, or the shared one
+func (cfg *AppConfig) GetStyle() StyleConfig {
+	switch cfg.Service {
+	case "pocket":
+		if cfg.Pocket.Style != nil {
+			return *cfg.Pocket.Style
+		}
+	case "omnivore":
+		if cfg.Omnivore.Style != nil {
+			return *cfg.Omnivore.Style
+		}
+	}
+	return cfg.Style
+}
+
+// GetFormat returns "pdf" for articles with one of the PDF tags, otherwise
+// the format of the active service or the shared one
+func (cfg *AppConfig) GetFormat(tags []string) string {
+	for _, tag := range tags {
+		for _, pdfTag := range cfg.PDF.Tags {
+			if strings.EqualFold(tag, pdfTag) {
+				return "pdf"
+			}
+		}
+	}
+
+	format := cfg.Format
+	switch {
+	case cfg.Service == "pocket" && cfg.Pocket.Format != "":
+		format = cfg.Pocket.Format
+	case cfg.Service == "omnivore" && cfg.Omnivore.Format != "":
+		format = cfg.Omnivore.Format
+	}
+	if format == "" {
+		return "epub"
+	}
+	return format
+}
+
+// GetSyncInterval returns 0 when no schedule is configured
+func (cfg *AppConfig) GetSyncInterval() time.Duration {
+	interval, _ := time.ParseDuration(cfg.SyncInterval)
+	return interval
+}
+
+func (cfg *AppConfig) Validate() error {
+	switch cfg.Service {
+	case "pocket":
+		if cfg.Pocket.ConsumerKey == "" || cfg.Pocket.AccessToken == "" {
+			return fmt.Errorf("pocket needs a consumer key and an access token")
+		}
+	case "omnivore":
+		if cfg.Omnivore.ApiKey == "" || cfg.Omnivore.Username == "" {
+			return fmt.Errorf("omnivore needs a username and an api key")
+		}
+	default:
+		return fmt.Errorf("unknown service: %q", cfg.Service)
+	}
+
+	return cfg.validateSettings()
+}
+
+// validateSettings checks everything but the service's credentials
+func (cfg *AppConfig) validateSettings() error {
+	if cfg.MaxArticles > 100 {
+		return fmt.Errorf("maxArticles must be at most 100")
+	}
+
+	if cfg.Concurrency > 8 {
+		return fmt.Errorf("concurrency must be at most 8")
+	}
+
+	if cfg.SyncTimeout != "" {
+		_, err := time.ParseDuration(cfg.SyncTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid syncTimeout: %w", err)
+		}
+	}
+
+	for _, format := range []string{cfg.Format, cfg.Pocket.Format, cfg.Omnivore.Format} {
+		if format != "" && format != "epub" && format != "pdf" {
+			return fmt.Errorf("format must be epub or pdf")
+		}
+	}
+
+	if cfg.PDF.Margin < 0 || cfg.PDF.Margin > 100 {
+		return fmt.Errorf("pdf.margin must be between 0 and 100 mm")
+	}
+
+	if cfg.Images.Contrast < 0 || cfg.Images.Contrast > 3 {
+		return fmt.Errorf("images.contrast must be between 0 and 3")
+	}
+
+	if _, err := parseNameTemplate(cfg.GetNameTemplate()); err != nil {
+		return fmt.Errorf("invalid nameTemplate: %w", err)
+	}
+
+	if cfg.TimeZone != "" {
+		_, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid timeZone: %w", err)
+		}
+	}
+
+	for _, font := range cfg.GetStyle().Fonts {
+		if font.Family == "" || font.File == "" {
+			return fmt.Errorf("fonts need a family and a file")
+		}
+	}
+
+	if cfg.SyncInterval != "" {
+		interval, err := time.ParseDuration(cfg.SyncInterval)
+		if err != nil {
+			return fmt.Errorf("invalid syncInterval: %w", err)
+		}
+		if interval < 15*time.Minute {
+			return fmt.Errorf("syncInterval must be at least 15m")
+		}
+	}
+
+	return nil
 }
 
 // ReaderService TODO: Possibly split these into separate interfaces to facilitate further reorganization
 type ReaderService interface {
-	GenerateFiles(maxArticles uint) error
+	GenerateFiles(ctx context.Context, opts SyncOptions) (*SyncSummary, error)
 	GetRemarkableConfig() *RemarkableConfig
+	SaveURL(ctx context.Context, u *url.URL, title string) error
+	Queue(ctx context.Context, maxArticles uint) ([]QueueItem, error)
 }
 
 func GetAppConfig() *AppConfig {
@@ -26,9 +235,31 @@ func GetAppConfig() *AppConfig {
 	var config *AppConfig
 	_ = yaml.Unmarshal(fileContent, &config)
 
+	if config == nil {
+		config = &AppConfig{}
+	}
 	return config
 }
 
+// SaveAppConfig validates the config and writes it to the config file
+func SaveAppConfig(config *AppConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	return writeAppConfig(config)
+}
+
+func writeAppConfig(config *AppConfig) error {
+	ymlContent, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(getConfigPath(), ymlContent, 0600)
+}
+
 func getConfigPath() string {
 	userHomeDir := getUserHomeDir()
 
@@ -58,7 +289,6 @@ func getUserHomeDir() string {
 }
 
 func writeRemarkableConfig(rmConfig *RemarkableConfig) {
-	configPath := getConfigPath()
 	appConfig := GetAppConfig()
 
 	switch rmConfig.Service {
@@ -70,15 +300,48 @@ func writeRemarkableConfig(rmConfig *RemarkableConfig) {
 		appConfig.Pocket.TargetFolderUUID = rmConfig.TargetFolderUUID
 	}
 
-	ymlContent, _ := yaml.Marshal(appConfig)
-	_ = os.WriteFile(configPath, ymlContent, os.ModePerm)
+	_ = writeAppConfig(appConfig)
 }
 
-func writeFile(fileName string, fileContent []byte) {
+// writeFile writes the whole content and fsyncs it before returning
+func writeFile(fileName string, fileContent []byte) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
 
-	// write the whole body at once
-	err := os.WriteFile(fileName, fileContent, 0644)
+	_, err = f.Write(fileContent)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// moveFile renames the file and fsyncs it at its new place
+func moveFile(oldName string, newName string) error {
+	err := os.Rename(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(newName)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+func syncDir(dirName string) error {
+	d, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
 }
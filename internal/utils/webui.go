@@ -0,0 +1,326 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/motemen/go-pocket/auth"
+)
+
+// the tablet's address on the USB network; the config page is only served
+// there, as it shows credentials
+const usbAddress = "10.11.99.1"
+
+type pendingPocketAuth struct {
+	consumerKey  string
+	requestToken *auth.RequestToken
+}
+
+func fromUSB(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+
+	host, _, _ := net.SplitHostPort(addr.String())
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.String() == usbAddress || ip.IsLoopback()) && localHost(r.Host)
+}
+
+// localHost checks the Host header too, so a page on another site can't
+// reach the config through a DNS name that resolves to the tablet
+func localHost(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.String() == usbAddress || ip.IsLoopback())
+}
+
+func newCSRFToken() string {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// configPost accepts only POSTs from the config page itself: the form must
+// carry the token the page was rendered with, which other sites can't read,
+// and the browser must not report another origin
+func (srv *Server) configPost(r *http.Request) bool {
+	if !fromUSB(r) || r.Method != http.MethodPost {
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	given := r.PostFormValue("csrf")
+	return subtle.ConstantTimeCompare([]byte(srv.csrfToken), []byte(given)) == 1
+}
+
+type configPage struct {
+	CSRF    string
+	Config  *AppConfig
+	Folders []Folder
+	Error   string
+	Message string
+}
+
+var configTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"folderChoice": func(folders []Folder, selected string, name string) folderChoice {
+		return folderChoice{folders, selected, name}
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta name="viewport" content="width=device-width, initial-scale=1"><title>pocket2rm setup</title>
+<style>label { display: block; margin: .4em 0 } fieldset { margin: 1em 0 }</style></head>
+<body>
+<h1>pocket2rm setup</h1>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="post" action="/config">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>Service
+<select name="service">
+<option value="pocket"{{if eq .Config.Service "pocket"}} selected{{end}}>Pocket</option>
+<option value="omnivore"{{if eq .Config.Service "omnivore"}} selected{{end}}>Omnivore</option>
+</select></label>
+<label>Maximum articles per sync <input type="number" name="maxArticles" min="1" max="100" value="{{.Config.GetMaxArticles}}"></label>
+<label>Articles converted at once <input type="number" name="concurrency" min="1" max="8" value="{{.Config.GetConcurrency}}"></label>
+<label>Sync every (e.g. 6h, empty to only sync when the reload file is removed) <input name="syncInterval" value="{{.Config.SyncInterval}}"></label>
+<fieldset><legend>Pocket</legend>
+<p>{{if .Config.Pocket.AccessToken}}Connected.{{else}}Not connected yet.{{end}}</p>
+<label>Consumer key <input name="pocket.consumerKey" value="{{.Config.Pocket.ConsumerKey}}"></label>
+<label>Filter: state <input name="pocket.state" value="{{index .Config.Pocket.RequestParams "state"}}" placeholder="unread"></label>
+<label>Filter: tag <input name="pocket.tag" value="{{index .Config.Pocket.RequestParams "tag"}}"></label>
+<label>Filter: content type <input name="pocket.contentType" value="{{index .Config.Pocket.RequestParams "contentType"}}" placeholder="article"></label>
+<label>Sort <input name="pocket.sort" value="{{index .Config.Pocket.RequestParams "sort"}}" placeholder="newest"></label>
+<label>Tag delivered items <input name="pocket.handledTag" value="{{.Config.Pocket.GetHandledTag}}"></label>
+<label>Tag failed items <input name="pocket.failedTag" value="{{.Config.Pocket.GetFailedTag}}"></label>
+<label>Remove trigger tag <input name="pocket.triggerTag" value="{{.Config.Pocket.TriggerTag}}" placeholder="to-tablet"></label>
+<label><input type="checkbox" name="pocket.archive"{{if .Config.Pocket.GetArchive}} checked{{end}}> Archive delivered items</label>
+<label><input type="checkbox" name="pocket.favorite"{{if .Config.Pocket.Favorite}} checked{{end}}> Favorite delivered items</label>
+<label>Folder {{template "folders" (folderChoice $.Folders .Config.Pocket.TargetFolderUUID "pocket.targetFolderUUID")}}</label>
+</fieldset>
+<fieldset><legend>Omnivore</legend>
+<label>Username <input name="omnivore.username" value="{{.Config.Omnivore.Username}}"></label>
+<label>API key <input type="password" name="omnivore.apiKey" placeholder="{{if .Config.Omnivore.ApiKey}}unchanged{{end}}"></label>
+<label>Query <input name="omnivore.query" value="{{.Config.Omnivore.Query}}" size="40"></label>
+<label>Handled label <input name="omnivore.handledLabel" value="{{.Config.Omnivore.GetHandledLabel}}"></label>
+<label>Skipped label <input name="omnivore.skippedLabel" value="{{.Config.Omnivore.GetSkippedLabel}}"></label>
+<label>Folder {{template "folders" (folderChoice $.Folders .Config.Omnivore.TargetFolderUUID "omnivore.targetFolderUUID")}}</label>
+</fieldset>
+<button type="submit">Save</button>
+</form>
+<form method="post" action="/config/pocket/connect">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="consumerKey" value="{{.Config.Pocket.ConsumerKey}}">
+<button type="submit"{{if not .Config.Pocket.ConsumerKey}} disabled{{end}}>Connect to Pocket</button>
+</form>
+<form method="post" action="/config/sync"><input type="hidden" name="csrf" value="{{.CSRF}}"><button type="submit">Sync now</button></form>
+</body>
+</html>
+{{define "folders"}}<select name="{{.Name}}">
+<option value="">create a new folder</option>
+{{range .Folders}}<option value="{{.UUID}}"{{if eq .UUID $.Selected}} selected{{end}}>{{.Name}}</option>{{end}}
+</select>{{end}}`))
+
+type folderChoice struct {
+	Folders  []Folder
+	Selected string
+	Name     string
+}
+
+func (srv *Server) renderConfig(w http.ResponseWriter, config *AppConfig, errorMessage string, message string) {
+	rm := Remarkable{Config: &RemarkableConfig{}}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	_ = configTemplate.Execute(w, configPage{srv.csrfToken, config, rm.ListFolders(), errorMessage, message})
+}
+
+func (srv *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !fromUSB(r) {
+		http.Error(w, "the configuration is only available over USB", http.StatusForbidden)
+		return
+	}
+
+	config := GetAppConfig()
+	if r.Method != http.MethodPost {
+		srv.renderConfig(w, config, "", r.FormValue("msg"))
+		return
+	}
+	if !srv.configPost(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	config.Service = r.FormValue("service")
+	maxArticles, err := strconv.ParseUint(r.FormValue("maxArticles"), 10, 32)
+	if err != nil {
+		srv.renderConfig(w, config, "invalid maximum article count", "")
+		return
+	}
+	config.MaxArticles = uint(maxArticles)
+	concurrency, err := strconv.ParseUint(r.FormValue("concurrency"), 10, 32)
+	if err != nil {
+		srv.renderConfig(w, config, "invalid concurrency", "")
+		return
+	}
+	config.Concurrency = uint(concurrency)
+	config.SyncInterval = strings.TrimSpace(r.FormValue("syncInterval"))
+
+	config.Pocket.ConsumerKey = strings.TrimSpace(r.FormValue("pocket.consumerKey"))
+	if config.Pocket.RequestParams == nil {
+		config.Pocket.RequestParams = map[string]string{}
+	}
+	for _, param := range []string{"state", "tag", "contentType", "sort"} {
+		setOrDelete(config.Pocket.RequestParams, param, strings.TrimSpace(r.FormValue("pocket."+param)))
+	}
+	config.Pocket.HandledTag = strings.TrimSpace(r.FormValue("pocket.handledTag"))
+	config.Pocket.FailedTag = strings.TrimSpace(r.FormValue("pocket.failedTag"))
+	config.Pocket.TriggerTag = strings.TrimSpace(r.FormValue("pocket.triggerTag"))
+	archive := r.FormValue("pocket.archive") != ""
+	config.Pocket.Archive = &archive
+	config.Pocket.Favorite = r.FormValue("pocket.favorite") != ""
+	config.Pocket.TargetFolderUUID = r.FormValue("pocket.targetFolderUUID")
+
+	config.Omnivore.Username = strings.TrimSpace(r.FormValue("omnivore.username"))
+	if apiKey := strings.TrimSpace(r.FormValue("omnivore.apiKey")); apiKey != "" {
+		config.Omnivore.ApiKey = apiKey
+	}
+	config.Omnivore.Query = r.FormValue("omnivore.query")
+	config.Omnivore.HandledLabel = strings.TrimSpace(r.FormValue("omnivore.handledLabel"))
+	config.Omnivore.SkippedLabel = strings.TrimSpace(r.FormValue("omnivore.skippedLabel"))
+	config.Omnivore.TargetFolderUUID = r.FormValue("omnivore.targetFolderUUID")
+
+	if config.Service == "pocket" && config.Pocket.ConsumerKey != "" && config.Pocket.AccessToken == "" {
+		// on the first setup the access token is still missing, Connect
+		// gets it with the consumer key saved here
+		err = config.validateSettings()
+		if err == nil {
+			err = writeAppConfig(config)
+		}
+		if err != nil {
+			srv.renderConfig(w, config, err.Error(), "")
+			return
+		}
+		http.Redirect(w, r, "/config?msg=Saved.+Connect+to+Pocket+to+finish+the+setup.", http.StatusSeeOther)
+		return
+	}
+
+	err = SaveAppConfig(config)
+	if err != nil {
+		srv.renderConfig(w, config, err.Error(), "")
+		return
+	}
+
+	http.Redirect(w, r, "/config?msg=Saved.", http.StatusSeeOther)
+}
+
+func setOrDelete(params map[string]string, key string, value string) {
+	if value == "" {
+		delete(params, key)
+	} else {
+		params[key] = value
+	}
+}
+
+func (srv *Server) handlePocketConnect(w http.ResponseWriter, r *http.Request) {
+	if !srv.configPost(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	consumerKey := r.FormValue("consumerKey")
+	redirectURL := "http://" + r.Host + "/config/pocket/callback"
+	requestToken, err := auth.ObtainRequestToken(consumerKey, redirectURL)
+	if err != nil {
+		srv.renderConfig(w, GetAppConfig(), fmt.Sprintf("Could not obtain request token: %s", err), "")
+		return
+	}
+
+	srv.mu.Lock()
+	srv.pocketAuth = &pendingPocketAuth{consumerKey, requestToken}
+	srv.mu.Unlock()
+
+	http.Redirect(w, r, auth.GenerateAuthorizationURL(requestToken, redirectURL), http.StatusSeeOther)
+}
+
+func (srv *Server) handlePocketCallback(w http.ResponseWriter, r *http.Request) {
+	if !fromUSB(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	srv.mu.Lock()
+	pending := srv.pocketAuth
+	srv.pocketAuth = nil
+	srv.mu.Unlock()
+	if pending == nil {
+		http.Redirect(w, r, "/config", http.StatusSeeOther)
+		return
+	}
+
+	authorization, err := auth.ObtainAccessToken(pending.consumerKey, pending.requestToken)
+	if err != nil {
+		srv.renderConfig(w, GetAppConfig(), fmt.Sprintf("Could not obtain access token: %s", err), "")
+		return
+	}
+
+	config := GetAppConfig()
+	if config.Service == "" {
+		config.Service = "pocket"
+	}
+	config.Pocket.ConsumerKey = pending.consumerKey
+	config.Pocket.AccessToken = authorization.AccessToken
+	err = writeAppConfig(config)
+	if err != nil {
+		srv.renderConfig(w, config, err.Error(), "")
+		return
+	}
+
+	http.Redirect(w, r, "/config?msg=Connected+to+Pocket.", http.StatusSeeOther)
+}
+
+func (srv *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if !srv.configPost(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// a config saved before Connect has no pocket access token yet
+	if err := GetAppConfig().Validate(); err != nil {
+		srv.renderConfig(w, GetAppConfig(), err.Error(), "")
+		return
+	}
+
+	RequestSync()
+	http.Redirect(w, r, "/config?msg=Sync+started.", http.StatusSeeOther)
+}